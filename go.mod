@@ -1,3 +1,3 @@
 module ns-check
 
-go 1.19
+go 1.20
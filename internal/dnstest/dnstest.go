@@ -0,0 +1,280 @@
+// Package dnstest 提供测试用的假 DNS 服务器和 wire format 响应构造方法。
+// 假服务器监听 127.0.0.1 的随机端口，探测时以 host:port 作为 nameserver
+package dnstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ns-check/internal/probe"
+)
+
+// Handler 根据查询报文返回响应，tcp 表示通过 TCP 收到，返回 nil 表示不响应
+type Handler func(query []byte, tcp bool) []byte
+
+// Server 在同一端口同时监听 UDP 和 TCP 的假 DNS 服务器
+type Server struct {
+	// Addr 监听地址，可以直接作为 nameserver
+	Addr       string
+	handler    Handler
+	udp        net.PacketConn
+	tcp        net.Listener
+	wg         sync.WaitGroup
+	udpQueries atomic.Int64
+	tcpQueries atomic.Int64
+}
+
+// NewServer 在随机端口启动假服务器，测试结束时关闭
+func NewServer(t testing.TB, handler Handler) *Server {
+	t.Helper()
+	udp, tcp, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Addr: udp.LocalAddr().String(), handler: handler, udp: udp, tcp: tcp}
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// listen 在同一个随机端口监听 UDP 和 TCP，TCP 端口被占用时换一个端口重试
+func listen() (net.PacketConn, net.Listener, error) {
+	var err error
+	for i := 0; i < 10; i++ {
+		var udp net.PacketConn
+		udp, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, err
+		}
+		var tcp net.Listener
+		tcp, err = net.Listen("tcp", udp.LocalAddr().String())
+		if err == nil {
+			return udp, tcp, nil
+		}
+		udp.Close()
+	}
+	return nil, nil, err
+}
+
+// Unused 返回一个没有服务监听的地址
+func Unused(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// Close 停止服务并等待处理结束
+func (s *Server) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+	s.wg.Wait()
+}
+
+// UDPQueries 返回通过 UDP 收到的查询数
+func (s *Server) UDPQueries() int { return int(s.udpQueries.Load()) }
+
+// TCPQueries 返回通过 TCP 收到的查询数，包括只建立连接不发送查询的探测
+func (s *Server) TCPQueries() int { return int(s.tcpQueries.Load()) }
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.udpQueries.Add(1)
+		if resp := s.handler(append([]byte{}, buf[:n]...), false); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		s.tcpQueries.Add(1)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			if resp := s.handler(query, true); resp != nil {
+				conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp))))
+				conn.Write(resp)
+			}
+		}()
+	}
+}
+
+// questionEnd 返回查询中问题段结束的偏移
+func questionEnd(query []byte) int {
+	off := 12
+	for off < len(query) && query[off] != 0 {
+		off += 1 + int(query[off])
+	}
+	return off + 5
+}
+
+// Reply 构造对 query 的响应，复制 ID 和问题段，回答的名称指向问题中的域名
+func Reply(query []byte, rcode int, answers ...probe.RR) []byte {
+	end := questionEnd(query)
+	msg := make([]byte, 12, 512)
+	copy(msg, query[:2])
+	binary.BigEndian.PutUint16(msg[2:], 0x8180|uint16(rcode)) // QR RD RA
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	msg = append(msg, query[12:end]...)
+	for _, rr := range answers {
+		msg = append(msg, 0xc0, 0x0c)
+		msg = binary.BigEndian.AppendUint16(msg, rr.Type)
+		msg = binary.BigEndian.AppendUint16(msg, rr.Class)
+		msg = binary.BigEndian.AppendUint32(msg, rr.TTL)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rr.Data)))
+		msg = append(msg, rr.Data...)
+	}
+	return msg
+}
+
+// WithSOA 在响应的授权段追加一条 SOA，名称指向问题中的域名，
+// 需要在 WithNSID 之前调用
+func WithSOA(msg []byte, ttl, minimum uint32) []byte {
+	binary.BigEndian.PutUint16(msg[8:], binary.BigEndian.Uint16(msg[8:])+1)
+	msg = append(msg, 0xc0, 0x0c)
+	msg = binary.BigEndian.AppendUint16(msg, probe.TypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, probe.ClassINET)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	// MNAME 和 RNAME 都指向问题中的域名，之后是 SERIAL、REFRESH、RETRY、EXPIRE、MINIMUM
+	msg = binary.BigEndian.AppendUint16(msg, 4+20)
+	msg = append(msg, 0xc0, 0x0c, 0xc0, 0x0c)
+	for _, v := range []uint32{1, 3600, 600, 86400, minimum} {
+		msg = binary.BigEndian.AppendUint32(msg, v)
+	}
+	return msg
+}
+
+// WithNSID 在响应的附加段追加带 NSID 选项的 OPT 记录
+func WithNSID(msg []byte, nsid string) []byte {
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])+1)
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, probe.TypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, 4096)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(4+len(nsid)))
+	msg = binary.BigEndian.AppendUint16(msg, 3)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(nsid)))
+	return append(msg, nsid...)
+}
+
+// Truncated 设置响应的 TC 标志并去掉所有记录，模拟 UDP 放不下的响应
+func Truncated(msg []byte) []byte {
+	msg = msg[:questionEnd(msg)]
+	binary.BigEndian.PutUint16(msg[2:], binary.BigEndian.Uint16(msg[2:])|0x0200)
+	binary.BigEndian.PutUint16(msg[6:], 0)
+	binary.BigEndian.PutUint16(msg[8:], 0)
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	return msg
+}
+
+// A 返回一条 A 记录
+func A(ip string, ttl uint32) probe.RR {
+	return probe.RR{Type: probe.TypeA, Class: probe.ClassINET, TTL: ttl, Data: net.ParseIP(ip).To4()}
+}
+
+// TXT 返回一条只有一个字符串的 TXT 记录
+func TXT(class uint16, text string) probe.RR {
+	return probe.RR{Type: probe.TypeTXT, Class: class, Data: append([]byte{byte(len(text))}, text...)}
+}
+
+// HasOPT 判断查询是否带有 EDNS OPT 记录
+func HasOPT(query []byte) bool {
+	return binary.BigEndian.Uint16(query[10:]) > 0
+}
+
+// NewDoTServer 在随机端口启动只完成 TLS 握手的服务器，证书对 127.0.0.1 有效，
+// 返回监听地址和签发证书的根证书，测试结束时关闭
+func NewDoTServer(t testing.TB) (string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	return ln.Addr().String(), pool
+}
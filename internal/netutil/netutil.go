@@ -0,0 +1,43 @@
+// Package netutil 提供 ns-check 和 ns-master 共用的网络资源释放工具
+package netutil
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// maxDrainBytes 关闭前最多读取的字节数，超过则直接关闭放弃连接复用
+const maxDrainBytes = 64 << 10
+
+// DrainAndClose 读完并关闭 HTTP 响应体，使底层连接可以被复用而不是泄漏
+func DrainAndClose(body io.ReadCloser) error {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrainBytes))
+	return body.Close()
+}
+
+// Sleep 等待 d 或 ctx 结束，ctx 结束时返回 false，计时器总会被释放
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// SleepOrWake 与 Sleep 相同，但 wake 有信号时提前返回 true
+func SleepOrWake(ctx context.Context, d time.Duration, wake <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-wake:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
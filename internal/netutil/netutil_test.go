@@ -0,0 +1,77 @@
+package netutil
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type trackingBody struct {
+	*strings.Reader
+	closed bool
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestDrainAndClose(t *testing.T) {
+	body := &trackingBody{Reader: strings.NewReader("unread response body")}
+	if err := DrainAndClose(body); err != nil {
+		t.Fatal(err)
+	}
+	if !body.closed || body.Len() != 0 {
+		t.Errorf("closed %v, %d bytes left, want closed and drained", body.closed, body.Len())
+	}
+
+	// 超过上限的响应体不会被整个读完
+	large := &trackingBody{Reader: strings.NewReader(strings.Repeat("x", 2*maxDrainBytes))}
+	DrainAndClose(large)
+	if !large.closed || large.Len() != maxDrainBytes {
+		t.Errorf("closed %v, %d bytes left, want closed with %d left", large.closed, large.Len(), maxDrainBytes)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	start := time.Now()
+	if !Sleep(context.Background(), 20*time.Millisecond) {
+		t.Error("Sleep returned false without cancel")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Sleep returned after %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	if Sleep(ctx, time.Hour) {
+		t.Error("Sleep returned true after cancel")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled Sleep took %s", elapsed)
+	}
+}
+
+func TestSleepOrWake(t *testing.T) {
+	wake := make(chan struct{}, 1)
+	wake <- struct{}{}
+	start := time.Now()
+	if !SleepOrWake(context.Background(), time.Hour, wake) {
+		t.Error("SleepOrWake returned false on wake")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("woken SleepOrWake took %s", elapsed)
+	}
+
+	// nil wake 与 Sleep 相同
+	if !SleepOrWake(context.Background(), time.Millisecond, nil) {
+		t.Error("SleepOrWake returned false without cancel")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if SleepOrWake(ctx, time.Hour, nil) {
+		t.Error("SleepOrWake returned true after cancel")
+	}
+}
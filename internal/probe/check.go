@@ -0,0 +1,108 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Mode 探测方式
+type Mode string
+
+const (
+	// ModeTCPConnect 只建立到 53 端口的 TCP 连接
+	ModeTCPConnect Mode = "tcp-connect"
+	// ModeUDPQuery 通过 UDP 查询根域名的 NS 记录
+	ModeUDPQuery Mode = "udp-query"
+	// ModeDoTHandshake 与 853 端口完成 TLS 握手
+	ModeDoTHandshake Mode = "dot-handshake"
+)
+
+// DoTRootCAs dot-handshake 校验证书使用的根证书，nil 时使用系统根证书
+var DoTRootCAs *x509.CertPool
+
+// ParseMode 校验探测方式
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeTCPConnect, ModeUDPQuery, ModeDoTHandshake:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown probe mode %q, want %s, %s or %s", s, ModeTCPConnect, ModeUDPQuery, ModeDoTHandshake)
+}
+
+// Check 按指定方式探测一次，返回耗时。nameserver 带端口时所有方式都使用该端口
+func Check(ctx context.Context, mode Mode, nameserver string, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	startTime := time.Now()
+
+	switch mode {
+	case ModeUDPQuery:
+		resp, latency, err := Query(ctx, nameserver, ".", TypeNS, ClassINET, timeout)
+		if err != nil {
+			return 0, err
+		}
+		if resp.Rcode == RcodeServFail || resp.Rcode == RcodeRefused {
+			return 0, fmt.Errorf("query refused or failed, rcode %d", resp.Rcode)
+		}
+		return latency, nil
+	case ModeDoTHandshake:
+		dialer := &tls.Dialer{Config: &tls.Config{ServerName: Host(nameserver), RootCAs: DoTRootCAs}}
+		conn, err := dialer.DialContext(ctx, "tcp", Addr(nameserver, "853"))
+		if err != nil {
+			return 0, err
+		}
+		conn.Close()
+		return time.Since(startTime), nil
+	default:
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", Addr(nameserver, "53"))
+		if err != nil {
+			return 0, err
+		}
+		conn.Close()
+		return time.Since(startTime), nil
+	}
+}
+
+// Result 多次探测的汇总结果
+type Result struct {
+	Mode      Mode          `json:"mode"`
+	Samples   int           `json:"samples"`
+	Successes int           `json:"successes"`
+	Latency   time.Duration `json:"latency"`
+	Score     time.Duration `json:"score"`
+	Err       string        `json:"error,omitempty"`
+}
+
+// Healthy 至少一半的探测成功即视为健康
+func (r Result) Healthy() bool {
+	return r.Successes > 0 && r.Successes*2 >= r.Samples
+}
+
+// Measure 连续探测 samples 次，Latency 为成功探测的平均耗时，
+// Score 为按成功率放大的 Latency，越小越好
+func Measure(ctx context.Context, mode Mode, nameserver string, timeout time.Duration, samples int) Result {
+	if samples < 1 {
+		samples = 1
+	}
+	result := Result{Mode: mode, Samples: samples}
+	var total time.Duration
+	for i := 0; i < samples; i++ {
+		latency, err := Check(ctx, mode, nameserver, timeout)
+		if err != nil {
+			result.Err = err.Error()
+			continue
+		}
+		result.Successes++
+		total += latency
+	}
+	if result.Successes > 0 {
+		result.Latency = total / time.Duration(result.Successes)
+		result.Score = result.Latency * time.Duration(samples) / time.Duration(result.Successes)
+	}
+	return result
+}
@@ -0,0 +1,501 @@
+// Package probe 提供 ns-check 和 ns-master 共用的 nameserver 探测方法
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS 类型和类别
+const (
+	TypeA   uint16 = 1
+	TypeNS  uint16 = 2
+	TypeSOA uint16 = 6
+	TypeTXT uint16 = 16
+	TypeOPT uint16 = 41
+
+	ClassINET  uint16 = 1
+	ClassCHAOS uint16 = 3
+)
+
+// RcodeSuccess 等常见响应码
+const (
+	RcodeSuccess  = 0
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+	RcodeRefused  = 5
+)
+
+const maxUDPSize = 4096
+
+// optionNSID EDNS NSID 选项码
+const optionNSID = 3
+
+var errShortMessage = errors.New("dns message too short")
+
+// RR 资源记录，Data 为未解析的 RDATA
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Response 解析后的 DNS 响应
+type Response struct {
+	ID         uint16
+	Rcode      int
+	Truncated  bool
+	Answers    []RR
+	Authority  []RR
+	Additional []RR
+}
+
+// BuildQuery 构造一个开启递归的标准查询
+func BuildQuery(id uint16, name string, qtype, qclass uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)      // QDCOUNT
+	msg, err := appendName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, qclass)
+	return msg, nil
+}
+
+func appendName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid dns name %q", name)
+			}
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	return append(msg, 0), nil
+}
+
+// ParseResponse 解析 DNS 响应头、跳过问题段并读取回答段
+func ParseResponse(msg []byte) (*Response, error) {
+	if len(msg) < 12 {
+		return nil, errShortMessage
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, errors.New("dns message is not a response")
+	}
+	resp := &Response{
+		ID:        binary.BigEndian.Uint16(msg[0:]),
+		Rcode:     int(flags & 0x000f),
+		Truncated: flags&0x0200 != 0,
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+		if off > len(msg) {
+			return nil, errShortMessage
+		}
+	}
+	var err error
+	if resp.Answers, off, err = readRRs(msg, off, ancount); err != nil {
+		return nil, err
+	}
+	if resp.Authority, off, err = readRRs(msg, off, nscount); err != nil {
+		return nil, err
+	}
+	if resp.Additional, _, err = readRRs(msg, off, arcount); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func readRRs(msg []byte, off, count int) ([]RR, int, error) {
+	var rrs []RR
+	for i := 0; i < count; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, 0, errShortMessage
+		}
+		rr := RR{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[off:]),
+			Class: binary.BigEndian.Uint16(msg[off+2:]),
+			TTL:   binary.BigEndian.Uint32(msg[off+4:]),
+		}
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return nil, 0, errShortMessage
+		}
+		rr.Data = msg[off : off+rdlength]
+		off += rdlength
+		rrs = append(rrs, rr)
+	}
+	return rrs, off, nil
+}
+
+// readName 读取可能带压缩指针的域名，返回域名和其后的偏移
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errShortMessage
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errShortMessage
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("too many dns compression pointers")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errShortMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// TXT 解析 TXT 记录的 RDATA
+func TXT(data []byte) []string {
+	var texts []string
+	for len(data) > 0 {
+		length := int(data[0])
+		if 1+length > len(data) {
+			break
+		}
+		texts = append(texts, string(data[1:1+length]))
+		data = data[1+length:]
+	}
+	return texts
+}
+
+// AddNSID 在查询中追加请求 NSID 的 EDNS OPT 记录
+func AddNSID(query []byte) []byte {
+	arcount := binary.BigEndian.Uint16(query[10:])
+	binary.BigEndian.PutUint16(query[10:], arcount+1)
+	query = append(query, 0) // 根域名
+	query = binary.BigEndian.AppendUint16(query, TypeOPT)
+	query = binary.BigEndian.AppendUint16(query, maxUDPSize) // UDP 负载大小
+	query = binary.BigEndian.AppendUint32(query, 0)          // 扩展 rcode 和标志
+	query = binary.BigEndian.AppendUint16(query, 4)          // RDLENGTH
+	query = binary.BigEndian.AppendUint16(query, optionNSID)
+	return binary.BigEndian.AppendUint16(query, 0)
+}
+
+// NSID 从响应的 OPT 记录中读取 NSID，没有时返回空字符串
+func NSID(resp *Response) string {
+	for _, rr := range resp.Additional {
+		if rr.Type != TypeOPT {
+			continue
+		}
+		data := rr.Data
+		for len(data) >= 4 {
+			code := binary.BigEndian.Uint16(data)
+			length := int(binary.BigEndian.Uint16(data[2:]))
+			if 4+length > len(data) {
+				break
+			}
+			if code == optionNSID {
+				return string(data[4 : 4+length])
+			}
+			data = data[4+length:]
+		}
+	}
+	return ""
+}
+
+// Addr 返回 nameserver 指定端口的地址，兼容 IPv6。
+// nameserver 已经带端口（host:port 或 [v6]:port）时直接使用
+func Addr(nameserver, port string) string {
+	if _, _, err := net.SplitHostPort(nameserver); err == nil {
+		return nameserver
+	}
+	return net.JoinHostPort(nameserver, port)
+}
+
+// Host 返回 nameserver 去掉端口后的地址
+func Host(nameserver string) string {
+	if host, _, err := net.SplitHostPort(nameserver); err == nil {
+		return host
+	}
+	return nameserver
+}
+
+// Query 通过 UDP 向 nameserver 发送一次查询，返回响应和耗时
+func Query(ctx context.Context, nameserver, name string, qtype, qclass uint16, timeout time.Duration) (*Response, time.Duration, error) {
+	query, err := BuildQuery(uint16(rand.Intn(1<<16)), name, qtype, qclass)
+	if err != nil {
+		return nil, 0, err
+	}
+	return Exchange(ctx, nameserver, query, timeout)
+}
+
+// Exchange 通过 UDP 发送已构造好的查询，只接受 ID 匹配的响应
+func Exchange(ctx context.Context, nameserver string, query []byte, timeout time.Duration) (*Response, time.Duration, error) {
+	_, resp, latency, err := ExchangeRaw(ctx, nameserver, query, timeout)
+	return resp, latency, err
+}
+
+// ExchangeRaw 与 Exchange 相同，同时返回原始响应报文；响应被截断时改用 TCP 重新查询
+func ExchangeRaw(ctx context.Context, nameserver string, query []byte, timeout time.Duration) ([]byte, *Response, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	startTime := time.Now()
+
+	msg, resp, err := exchangeUDP(ctx, nameserver, query)
+	if err == nil && resp.Truncated {
+		msg, resp, err = exchangeTCP(ctx, nameserver, query)
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return msg, resp, time.Since(startTime), nil
+}
+
+func exchangeUDP(ctx context.Context, nameserver string, query []byte) ([]byte, *Response, error) {
+	id := binary.BigEndian.Uint16(query)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", Addr(nameserver, "53"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, nil, err
+	}
+
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := ParseResponse(buf[:n])
+		if err != nil || resp.ID != id {
+			// 忽略无法解析或 ID 不匹配的报文，继续等待直到超时
+			continue
+		}
+		return buf[:n], resp, nil
+	}
+}
+
+func exchangeTCP(ctx context.Context, nameserver string, query []byte) ([]byte, *Response, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", Addr(nameserver, "53"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// TCP 报文前有 2 字节长度
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, len(query)+2), uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, nil, err
+	}
+	resp, err := ParseResponse(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.ID != binary.BigEndian.Uint16(query) {
+		return nil, nil, errors.New("dns response id mismatch")
+	}
+	return msg, resp, nil
+}
+
+// Question 查询中的问题，EDNS 表示查询带有 OPT 记录，DO 为其中的 DNSSEC OK 标志，
+// CD 为头部的 Checking Disabled 标志，这三项都会改变上游返回的内容
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	EDNS  bool
+	DO    bool
+	CD    bool
+}
+
+// ParseQuery 校验报文是只有一个问题的标准查询并返回该问题
+func ParseQuery(msg []byte) (Question, error) {
+	if len(msg) < 12 {
+		return Question{}, errShortMessage
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 != 0 || flags&0x7800 != 0 {
+		return Question{}, errors.New("dns message is not a standard query")
+	}
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return Question{}, errors.New("dns query must have exactly one question")
+	}
+	name, off, err := readName(msg, 12)
+	if err != nil {
+		return Question{}, err
+	}
+	if off+4 > len(msg) {
+		return Question{}, errShortMessage
+	}
+	q := Question{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(msg[off:]),
+		Class: binary.BigEndian.Uint16(msg[off+2:]),
+		CD:    flags&0x0010 != 0,
+	}
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	rrs, _, err := readRRs(msg, off+4, count)
+	if err != nil {
+		return Question{}, err
+	}
+	for _, rr := range rrs {
+		if rr.Type == TypeOPT {
+			// OPT 记录的 TTL 字段为扩展 rcode、版本和标志，DO 是标志的最高位
+			q.EDNS = true
+			q.DO = rr.TTL&0x8000 != 0
+		}
+	}
+	return q, nil
+}
+
+// CopyQuestion 用 query 的问题段覆盖响应 msg 的问题段，保留客户端域名的大小写（DNS 0x20），
+// 两者不是同一个问题时返回错误
+func CopyQuestion(msg, query []byte) error {
+	msgEnd, err := questionEnd(msg)
+	if err != nil {
+		return err
+	}
+	queryEnd, err := questionEnd(query)
+	if err != nil {
+		return err
+	}
+	if msgEnd != queryEnd || !equalFoldASCII(msg[12:msgEnd-4], query[12:queryEnd-4]) ||
+		binary.BigEndian.Uint32(msg[msgEnd-4:]) != binary.BigEndian.Uint32(query[queryEnd-4:]) {
+		return errors.New("dns response question does not match the query")
+	}
+	copy(msg[12:], query[12:queryEnd])
+	return nil
+}
+
+// questionEnd 返回只有一个问题的报文中问题段结束的偏移
+func questionEnd(msg []byte) (int, error) {
+	if len(msg) < 12 {
+		return 0, errShortMessage
+	}
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return 0, errors.New("dns message must have exactly one question")
+	}
+	_, off, err := readName(msg, 12)
+	if err != nil {
+		return 0, err
+	}
+	if off+4 > len(msg) {
+		return 0, errShortMessage
+	}
+	return off + 4, nil
+}
+
+// equalFoldASCII 按 DNS 规则比较域名，只有 ASCII 字母不区分大小写
+func equalFoldASCII(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	lower := func(c byte) byte {
+		if 'A' <= c && c <= 'Z' {
+			return c + 'a' - 'A'
+		}
+		return c
+	}
+	for i := range a {
+		if lower(a[i]) != lower(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// AgeTTL 将报文中除 OPT 外所有记录的 TTL 减去 elapsed 秒，用于返回缓存的响应
+func AgeTTL(msg []byte, elapsed uint32) error {
+	if len(msg) < 12 {
+		return errShortMessage
+	}
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return err
+		}
+		off = next + 4
+	}
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < count; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return errShortMessage
+		}
+		if binary.BigEndian.Uint16(msg[off:]) != TypeOPT {
+			ttl := binary.BigEndian.Uint32(msg[off+4:])
+			if ttl > elapsed {
+				ttl -= elapsed
+			} else {
+				ttl = 0
+			}
+			binary.BigEndian.PutUint32(msg[off+4:], ttl)
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// 手工构造的报文，不依赖 BuildQuery
+var (
+	// ID 0x1234，RD，Example.COM A IN
+	fixtureQuery = []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		7, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'C', 'O', 'M', 0,
+		0x00, 0x01, 0x00, 0x01,
+	}
+	// 同一查询带 CD 标志和 DO=1 的 OPT 记录
+	fixtureQueryDO = []byte{
+		0x12, 0x34, 0x01, 0x10, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		7, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'C', 'O', 'M', 0,
+		0x00, 0x01, 0x00, 0x01,
+		0, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00,
+	}
+	// 对 example.com 的响应：两条 A 记录 TTL 300 和 60，附加段一条 OPT
+	fixtureResponse = []byte{
+		0x12, 0x34, 0x81, 0x80, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0x00, 0x01, 0x00, 0x01,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x04, 192, 0, 2, 1,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04, 192, 0, 2, 2,
+		0, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00,
+	}
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		want Question
+	}{
+		{"plain", fixtureQuery, Question{Name: "Example.COM.", Type: TypeA, Class: ClassINET}},
+		{"edns do cd", fixtureQueryDO, Question{Name: "Example.COM.", Type: TypeA, Class: ClassINET, EDNS: true, DO: true, CD: true}},
+	} {
+		got, err := ParseQuery(tc.msg)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: %+v, %v, want %+v", tc.name, got, err, tc.want)
+		}
+	}
+
+	twoQuestions := append([]byte{}, fixtureQuery...)
+	twoQuestions[5] = 2
+	notQuery := append([]byte{}, fixtureQuery...)
+	notQuery[2] |= 0x80
+	notStandard := append([]byte{}, fixtureQuery...)
+	notStandard[2] |= 0x10 // opcode 2
+	for name, msg := range map[string][]byte{
+		"response":       fixtureResponse,
+		"not standard":   notStandard,
+		"not a query":    notQuery,
+		"two questions":  twoQuestions,
+		"short header":   fixtureQuery[:11],
+		"short question": fixtureQuery[:len(fixtureQuery)-2],
+		"short opt":      fixtureQueryDO[:len(fixtureQueryDO)-3],
+	} {
+		if _, err := ParseQuery(msg); err == nil {
+			t.Errorf("%s: parsed, want error", name)
+		}
+	}
+}
+
+func TestAgeTTL(t *testing.T) {
+	for _, tc := range []struct {
+		elapsed uint32
+		want    []uint32
+	}{
+		{0, []uint32{300, 60}},
+		{50, []uint32{250, 10}},
+		// TTL 不会小于 0
+		{100, []uint32{200, 0}},
+	} {
+		msg := append([]byte{}, fixtureResponse...)
+		if err := AgeTTL(msg, tc.elapsed); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ParseResponse(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, rr := range resp.Answers {
+			if rr.TTL != tc.want[i] {
+				t.Errorf("elapsed %d: answer %d ttl %d, want %d", tc.elapsed, i, rr.TTL, tc.want[i])
+			}
+		}
+		// OPT 的 TTL 字段是标志，不能修改
+		if resp.Additional[0].TTL != 0x8000 {
+			t.Errorf("elapsed %d: OPT flags %#x changed", tc.elapsed, resp.Additional[0].TTL)
+		}
+	}
+	short := append([]byte{}, fixtureResponse[:len(fixtureResponse)-5]...)
+	if err := AgeTTL(short, 10); err == nil {
+		t.Error("aged a truncated message")
+	}
+}
+
+func TestCopyQuestion(t *testing.T) {
+	msg := append([]byte{}, fixtureResponse...)
+	if err := CopyQuestion(msg, fixtureQuery); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[12:29], fixtureQuery[12:29]) {
+		t.Errorf("question %q, want the query's %q", msg[12:29], fixtureQuery[12:29])
+	}
+	if !bytes.Equal(msg[29:], fixtureResponse[29:]) {
+		t.Error("records changed")
+	}
+
+	// 域名或类型不同时拒绝
+	otherName := append([]byte{}, fixtureResponse...)
+	otherName[13] = 'x'
+	otherType := append([]byte{}, fixtureResponse...)
+	binary.BigEndian.PutUint16(otherType[25:], TypeTXT)
+	for name, msg := range map[string][]byte{"name": otherName, "type": otherType} {
+		if err := CopyQuestion(msg, fixtureQuery); err == nil {
+			t.Errorf("other %s accepted", name)
+		}
+	}
+}
+
+func TestAddr(t *testing.T) {
+	for _, tc := range []struct{ nameserver, addr, host string }{
+		{"192.0.2.1", "192.0.2.1:53", "192.0.2.1"},
+		{"2001:db8::1", "[2001:db8::1]:53", "2001:db8::1"},
+		// 带端口时使用指定的端口
+		{"127.0.0.1:5353", "127.0.0.1:5353", "127.0.0.1"},
+		{"[::1]:5353", "[::1]:5353", "::1"},
+	} {
+		if got := Addr(tc.nameserver, "53"); got != tc.addr {
+			t.Errorf("Addr(%q) = %q, want %q", tc.nameserver, got, tc.addr)
+		}
+		if got := Host(tc.nameserver); got != tc.host {
+			t.Errorf("Host(%q) = %q, want %q", tc.nameserver, got, tc.host)
+		}
+	}
+}
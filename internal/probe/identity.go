@@ -0,0 +1,43 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// identityNames 用于查询服务器身份的 CHAOS TXT 域名，按顺序尝试
+var identityNames = []string{"id.server", "hostname.bind"}
+
+// Identity 查询 nameserver 的身份标识，依次尝试 CHAOS TXT 和 EDNS NSID，
+// 同一 anycast 服务背后的不同地址会返回相同的标识
+func Identity(ctx context.Context, nameserver string, timeout time.Duration) (string, error) {
+	for _, name := range identityNames {
+		resp, _, err := Query(ctx, nameserver, name, TypeTXT, ClassCHAOS, timeout)
+		if err != nil {
+			continue
+		}
+		for _, rr := range resp.Answers {
+			if rr.Type == TypeTXT {
+				if identity := strings.Join(TXT(rr.Data), ""); identity != "" {
+					return identity, nil
+				}
+			}
+		}
+	}
+
+	query, err := BuildQuery(uint16(rand.Intn(1<<16)), ".", TypeNS, ClassINET)
+	if err != nil {
+		return "", err
+	}
+	resp, _, err := Exchange(ctx, nameserver, AddNSID(query), timeout)
+	if err != nil {
+		return "", err
+	}
+	if identity := NSID(resp); identity != "" {
+		return identity, nil
+	}
+	return "", errors.New("nameserver does not report its identity")
+}
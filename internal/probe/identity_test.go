@@ -0,0 +1,99 @@
+package probe_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"ns-check/internal/dnstest"
+	"ns-check/internal/probe"
+)
+
+// identityServer 按查询的域名和类别应答，chaos 为空时拒绝 CHAOS 查询，nsid 为空时不带 NSID
+func identityServer(t *testing.T, chaos map[string]string, nsid string) *dnstest.Server {
+	return dnstest.NewServer(t, func(query []byte, tcp bool) []byte {
+		q, err := probe.ParseQuery(query)
+		if err != nil {
+			t.Errorf("bad query: %v", err)
+			return nil
+		}
+		if q.Class == probe.ClassCHAOS {
+			if text, ok := chaos[q.Name]; ok {
+				return dnstest.Reply(query, probe.RcodeSuccess, dnstest.TXT(probe.ClassCHAOS, text))
+			}
+			return dnstest.Reply(query, probe.RcodeRefused)
+		}
+		if !dnstest.HasOPT(query) {
+			t.Errorf("NSID fallback query for %q has no OPT record", q.Name)
+		}
+		resp := dnstest.Reply(query, probe.RcodeSuccess)
+		if nsid != "" {
+			resp = dnstest.WithNSID(resp, nsid)
+		}
+		return resp
+	})
+}
+
+func TestIdentityChaosTXT(t *testing.T) {
+	a := identityServer(t, map[string]string{"id.server.": "pop-a"}, "")
+	b := identityServer(t, map[string]string{"hostname.bind.": "pop-b"}, "")
+
+	for _, tc := range []struct {
+		s    *dnstest.Server
+		want string
+	}{{a, "pop-a"}, {b, "pop-b"}} {
+		got, err := probe.Identity(context.Background(), tc.s.Addr, time.Second)
+		if err != nil || got != tc.want {
+			t.Errorf("Identity(%s) = %q, %v, want %q", tc.s.Addr, got, err, tc.want)
+		}
+	}
+}
+
+func TestIdentityNSIDFallback(t *testing.T) {
+	s := identityServer(t, nil, "nsid-a")
+	got, err := probe.Identity(context.Background(), s.Addr, time.Second)
+	if err != nil || got != "nsid-a" {
+		t.Errorf("Identity = %q, %v, want nsid-a", got, err)
+	}
+	// id.server 和 hostname.bind 都被拒绝后才用 NSID
+	if n := s.UDPQueries(); n != 3 {
+		t.Errorf("%d queries, want 2 CHAOS and 1 NSID", n)
+	}
+}
+
+func TestIdentityUnavailable(t *testing.T) {
+	s := identityServer(t, nil, "")
+	if got, err := probe.Identity(context.Background(), s.Addr, time.Second); err == nil {
+		t.Errorf("Identity = %q, want error", got)
+	}
+}
+
+func TestNSID(t *testing.T) {
+	query, err := probe.BuildQuery(1, ".", probe.TypeNS, probe.ClassINET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query = probe.AddNSID(query)
+	if !dnstest.HasOPT(query) {
+		t.Fatal("AddNSID did not add an OPT record")
+	}
+	if _, err := probe.ParseQuery(query); err != nil {
+		t.Fatalf("query with NSID does not parse: %v", err)
+	}
+
+	for _, tc := range []struct {
+		resp []byte
+		want string
+	}{
+		{dnstest.WithNSID(dnstest.Reply(query, probe.RcodeSuccess), "ns1.pop-a"), "ns1.pop-a"},
+		{dnstest.Reply(query, probe.RcodeSuccess), ""},
+	} {
+		resp, err := probe.ParseResponse(tc.resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := probe.NSID(resp); got != tc.want {
+			t.Errorf("NSID = %q, want %q", got, tc.want)
+		}
+	}
+}
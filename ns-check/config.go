@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// loadConfig 读取配置文件，每行格式为 "flag名 = 值"，# 开头为注释
+func loadConfig(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: want name = value", path, lineNo)
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown option %q", path, lineNo, name)
+		}
+		config[name] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// applyConfig 将配置文件中的值应用到未在命令行中指定的 flag 上，命令行优先
+func applyConfig(config map[string]string) error {
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	for name, value := range config {
+		if setOnCommandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("option %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// writeConfig 按给定顺序写出带注释的配置文件，注释取自 flag 的说明，未设置的项跳过
+func writeConfig(w io.Writer, names []string, config map[string]string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# ns-check config file, generated by \"ns-check init\".")
+	fmt.Fprintln(bw, "# Every option is a command line flag name, flags given on the command line take precedence.")
+	for _, name := range names {
+		if _, ok := config[name]; !ok {
+			continue
+		}
+		fmt.Fprintln(bw)
+		if f := flag.Lookup(name); f != nil {
+			fmt.Fprintf(bw, "# %s\n", f.Usage)
+		}
+		fmt.Fprintf(bw, "%s = %s\n", name, config[name])
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// stopper 可以取消的定时器，测试中替换为虚拟时钟的定时器
+type stopper interface {
+	Stop() bool
+}
+
+// writeDamper 限制两次写入 resolv.conf 之间的最小间隔，间隔内的变化会被暂存，
+// 到期后自动写入；当前首选 nameserver 不再健康或当前没有 nameserver 时立即写入
+type writeDamper struct {
+	mu          sync.Mutex
+	minInterval time.Duration
+	now         func() time.Time
+	afterFunc   func(d time.Duration, f func()) stopper
+	write       func(nameservers []string) error
+	onFlush     func(nameservers []string)
+	lastWrite   time.Time
+	written     []string
+	pending     []string
+	timer       stopper
+}
+
+func newWriteDamper(minInterval time.Duration, write func([]string) error) *writeDamper {
+	return &writeDamper{
+		minInterval: minInterval,
+		now:         time.Now,
+		afterFunc:   timeAfterFunc,
+		write:       write,
+	}
+}
+
+func timeAfterFunc(d time.Duration, f func()) stopper {
+	return time.AfterFunc(d, f)
+}
+
+// submit 提交本轮选出的 nameserver，healthy 为本轮检测健康的全部 nameserver
+func (d *writeDamper) submit(nameservers, healthy []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.minInterval <= 0 {
+		return d.writeLocked(nameservers)
+	}
+	if equalNameservers(nameservers, d.written) {
+		// 已经是当前写入的内容，之前暂存的变化也不再需要
+		d.clearPendingLocked()
+		return nil
+	}
+	elapsed := d.now().Sub(d.lastWrite)
+	if d.lastWrite.IsZero() || elapsed >= d.minInterval {
+		return d.writeLocked(nameservers)
+	}
+	// 上次写入为空（全部不可用）时恢复也要立即写入
+	if len(d.written) == 0 {
+		logger.Println("No nameserver is written, bypass minimum write interval")
+		return d.writeLocked(nameservers)
+	}
+	if !containsNameserver(healthy, d.written[0]) {
+		logger.Printf("Primary nameserver %s is unhealthy, bypass minimum write interval", d.written[0])
+		return d.writeLocked(nameservers)
+	}
+
+	d.pending = nameservers
+	if d.timer == nil {
+		d.timer = d.afterFunc(d.minInterval-elapsed, d.flush)
+	}
+	logger.Printf("Write of %v suppressed for %v by minimum write interval", nameservers, d.minInterval-elapsed)
+	return nil
+}
+
+// current 返回当前实际写入的 nameserver
+func (d *writeDamper) current() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.written
+}
+
+// flush 最小间隔到期后写入暂存的变化，写入后调用 onFlush
+func (d *writeDamper) flush() {
+	d.mu.Lock()
+	d.timer = nil
+	pending := d.pending
+	if pending == nil {
+		d.mu.Unlock()
+		return
+	}
+	err := d.writeLocked(pending)
+	d.mu.Unlock()
+
+	if err != nil {
+		logger.Println("Failed to write pending resolv.conf:", err)
+		return
+	}
+	logger.Println("Pending nameservers written after minimum write interval", pending)
+	if d.onFlush != nil {
+		d.onFlush(pending)
+	}
+}
+
+func (d *writeDamper) writeLocked(nameservers []string) error {
+	if err := d.write(nameservers); err != nil {
+		return err
+	}
+	d.lastWrite = d.now()
+	d.written = nameservers
+	d.clearPendingLocked()
+	return nil
+}
+
+func (d *writeDamper) clearPendingLocked() {
+	d.pending = nil
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
+
+func equalNameservers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsNameserver(nameservers []string, nameserver string) bool {
+	for _, ns := range nameservers {
+		if ns == nameserver {
+			return true
+		}
+	}
+	return false
+}
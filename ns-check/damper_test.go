@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeWriter 记录每次写入的 nameserver
+type fakeWriter struct {
+	writes [][]string
+	err    error
+}
+
+func (f *fakeWriter) write(nameservers []string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.writes = append(f.writes, nameservers)
+	return nil
+}
+
+func newTestDamper(clock *fakeClock, writer *fakeWriter) *writeDamper {
+	d := newWriteDamper(time.Minute, writer.write)
+	d.now = clock.Now
+	d.afterFunc = clock.AfterFunc
+	return d
+}
+
+func TestDamperSuppressesWithinInterval(t *testing.T) {
+	clock := newFakeClock()
+	writer := &fakeWriter{}
+	d := newTestDamper(clock, writer)
+
+	if err := d.submit([]string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.1", "10.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	// 首选仍然健康，间隔内的变化被暂存
+	clock.Advance(10 * time.Second)
+	d.submit([]string{"10.0.0.2", "10.0.0.1"}, []string{"10.0.0.2", "10.0.0.1"})
+	clock.Advance(10 * time.Second)
+	d.submit([]string{"10.0.0.2"}, []string{"10.0.0.2", "10.0.0.1"})
+	if len(writer.writes) != 1 {
+		t.Fatalf("%d writes within the interval, want 1", len(writer.writes))
+	}
+	if got := d.current(); !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("current %v, want the first write", got)
+	}
+
+	// 变化回到当前写入的内容时丢弃暂存，到期后不再写入
+	d.submit([]string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.1", "10.0.0.2"})
+	clock.Advance(time.Hour)
+	if len(writer.writes) != 1 {
+		t.Errorf("%d writes after the change reverted, want 1", len(writer.writes))
+	}
+}
+
+func TestDamperDeferredApply(t *testing.T) {
+	clock := newFakeClock()
+	writer := &fakeWriter{}
+	d := newTestDamper(clock, writer)
+	g := newGuardian()
+	var flushed []string
+	d.onFlush = func(written []string) {
+		flushed = written
+		g.setPrimary(written[0])
+	}
+
+	d.submit([]string{"10.0.0.1"}, []string{"10.0.0.1", "10.0.0.2"})
+	g.resume("10.0.0.1")
+	clock.Advance(20 * time.Second)
+	d.submit([]string{"10.0.0.2"}, []string{"10.0.0.1", "10.0.0.2"})
+
+	// 最后一次写入 1 分钟后写入暂存的最新列表
+	clock.Advance(39 * time.Second)
+	if len(writer.writes) != 1 {
+		t.Fatalf("pending list written %s early", time.Second)
+	}
+	clock.Advance(time.Second)
+	want := [][]string{{"10.0.0.1"}, {"10.0.0.2"}}
+	if !reflect.DeepEqual(writer.writes, want) {
+		t.Fatalf("writes %v, want %v", writer.writes, want)
+	}
+	if !reflect.DeepEqual(flushed, []string{"10.0.0.2"}) || !reflect.DeepEqual(d.current(), flushed) {
+		t.Errorf("flushed %v, current %v, want 10.0.0.2", flushed, d.current())
+	}
+	if g.primary != "10.0.0.2" {
+		t.Errorf("guardian checks %s after the deferred write, want 10.0.0.2", g.primary)
+	}
+
+	// 定时写入的时间作为新的最后写入时间
+	clock.Advance(10 * time.Second)
+	d.submit([]string{"10.0.0.1"}, []string{"10.0.0.1", "10.0.0.2"})
+	if len(writer.writes) != 2 {
+		t.Errorf("%d writes 10s after the deferred write, want 2", len(writer.writes))
+	}
+}
+
+func TestDamperCriticalBypass(t *testing.T) {
+	clock := newFakeClock()
+	writer := &fakeWriter{}
+	d := newTestDamper(clock, writer)
+	d.onFlush = func([]string) { t.Error("onFlush called for an immediate write") }
+
+	d.submit([]string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.1", "10.0.0.2"})
+	clock.Advance(5 * time.Second)
+	d.submit([]string{"10.0.0.3"}, []string{"10.0.0.2", "10.0.0.3"})
+	clock.Advance(time.Second)
+	// 首选被身份上限去掉但仍然健康时不算失效
+	d.submit([]string{"10.0.0.2"}, []string{"10.0.0.3", "10.0.0.2"})
+
+	// 首选不在健康列表中，立即写入并取消暂存
+	want := [][]string{{"10.0.0.1", "10.0.0.2"}, {"10.0.0.3"}}
+	if !reflect.DeepEqual(writer.writes, want) {
+		t.Errorf("writes %v, want %v", writer.writes, want)
+	}
+	d.submit([]string{"10.0.0.3"}, []string{"10.0.0.3", "10.0.0.2"})
+	clock.Advance(time.Hour)
+	if len(writer.writes) != 2 {
+		t.Errorf("%d writes, want no deferred write after the bypass", len(writer.writes))
+	}
+}
+
+// TestDamperRecoverAfterAllDown 全部不可用时写入的空列表不能让恢复被最小间隔暂存
+func TestDamperRecoverAfterAllDown(t *testing.T) {
+	clock := newFakeClock()
+	writer := &fakeWriter{}
+	d := newTestDamper(clock, writer)
+
+	d.submit([]string{"10.0.0.1"}, []string{"10.0.0.1"})
+	clock.Advance(5 * time.Second)
+	d.submit([]string{}, nil)
+	clock.Advance(5 * time.Second)
+	d.submit([]string{"10.0.0.2"}, []string{"10.0.0.2"})
+
+	want := [][]string{{"10.0.0.1"}, {}, {"10.0.0.2"}}
+	if !reflect.DeepEqual(writer.writes, want) {
+		t.Errorf("writes %v, want %v", writer.writes, want)
+	}
+	if got := d.current(); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("current %v, want 10.0.0.2 right after recovery", got)
+	}
+}
+
+func TestDamperFlushWriteFails(t *testing.T) {
+	clock := newFakeClock()
+	writer := &fakeWriter{}
+	d := newTestDamper(clock, writer)
+	d.onFlush = func([]string) { t.Error("onFlush called for a failed write") }
+
+	d.submit([]string{"10.0.0.1"}, []string{"10.0.0.1"})
+	d.submit([]string{"10.0.0.2"}, []string{"10.0.0.1", "10.0.0.2"})
+	writer.err = errors.New("read-only file system")
+	clock.Advance(time.Minute)
+	if got := d.current(); !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("current %v after a failed write, want 10.0.0.1", got)
+	}
+}
+
+func TestDamperDisabled(t *testing.T) {
+	writer := &fakeWriter{}
+	d := newWriteDamper(0, writer.write)
+	d.submit([]string{"10.0.0.1"}, nil)
+	d.submit([]string{"10.0.0.2"}, nil)
+	if len(writer.writes) != 2 {
+		t.Errorf("%d writes with -min-write-interval 0, want 2", len(writer.writes))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"ns-check/internal/netutil"
+	"ns-check/internal/probe"
+)
+
+// guardian 在两轮检测之间只检查当前写入的首选 nameserver，
+// 连续失败达到阈值时触发一次立即检测
+type guardian struct {
+	mu       sync.Mutex
+	primary  string
+	paused   bool
+	failures int
+	wake     chan struct{}
+	check    func(ctx context.Context, nameserver string) error
+	sleep    func(ctx context.Context, d time.Duration) bool
+}
+
+func newGuardian() *guardian {
+	return &guardian{
+		wake:  make(chan struct{}, 1),
+		check: queryPrimary,
+		sleep: netutil.Sleep,
+	}
+}
+
+// queryPrimary 向首选 nameserver 发送一次 UDP 查询，SERVFAIL 和 REFUSED 也算失败
+func queryPrimary(ctx context.Context, nameserver string) error {
+	_, err := probe.Check(ctx, probe.ModeUDPQuery, nameserver, guardianTimeout)
+	return err
+}
+
+// pause 在完整检测期间暂停检查
+func (g *guardian) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = true
+}
+
+// resume 完整检测结束后以新的首选 nameserver 恢复检查
+func (g *guardian) resume(primary string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = false
+	g.primary = primary
+	g.failures = 0
+}
+
+// setPrimary 暂存的变化写入后更换首选 nameserver，不改变暂停状态
+func (g *guardian) setPrimary(primary string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.primary != primary {
+		g.primary = primary
+		g.failures = 0
+	}
+}
+
+func (g *guardian) run(ctx context.Context) {
+	for g.sleep(ctx, guardianInterval) {
+		g.checkOnce(ctx)
+	}
+}
+
+func (g *guardian) checkOnce(ctx context.Context) {
+	g.mu.Lock()
+	primary, paused := g.primary, g.paused
+	g.mu.Unlock()
+	if paused || primary == "" {
+		return
+	}
+
+	err := g.check(ctx, primary)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// 检查期间开始了完整检测或首选已变化，丢弃本次结果
+	if g.paused || g.primary != primary {
+		return
+	}
+	if err == nil {
+		g.failures = 0
+		return
+	}
+	g.failures++
+	logger.Printf("Guardian check of primary nameserver %s failed (%d/%d): %v", primary, g.failures, guardianThreshold, err)
+	if g.failures < guardianThreshold {
+		return
+	}
+	g.failures = 0
+	logger.Printf("Primary nameserver %s failed %d consecutive checks, triggering an immediate detection", primary, guardianThreshold)
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"ns-check/internal/dnstest"
+	"ns-check/internal/probe"
+)
+
+// setGuardianFlags 设置 guardian 参数，测试结束后还原
+func setGuardianFlags(t *testing.T, interval time.Duration, threshold int) {
+	t.Helper()
+	savedInterval, savedThreshold := guardianInterval, guardianThreshold
+	t.Cleanup(func() { guardianInterval, guardianThreshold = savedInterval, savedThreshold })
+	guardianInterval, guardianThreshold = interval, threshold
+}
+
+// fakePrimary 按 nameserver 返回检查结果并记录检查次数
+type fakePrimary struct {
+	mu      sync.Mutex
+	failing map[string]bool
+	checks  int
+}
+
+func (f *fakePrimary) check(ctx context.Context, nameserver string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checks++
+	if f.failing[nameserver] {
+		return errors.New("timeout")
+	}
+	return nil
+}
+
+func newTestGuardian(clock *fakeClock, primary *fakePrimary) *guardian {
+	g := newGuardian()
+	g.check = primary.check
+	g.sleep = clock.Sleep
+	return g
+}
+
+// TestGuardianTimeToEmergencyCycle 首选失效后经过 threshold 个检查间隔触发立即检测
+func TestGuardianTimeToEmergencyCycle(t *testing.T) {
+	setGuardianFlags(t, 5*time.Second, 3)
+	clock := newFakeClock()
+	primary := &fakePrimary{failing: map[string]bool{"10.0.0.1": true}}
+	g := newTestGuardian(clock, primary)
+	g.resume("10.0.0.1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := clock.Now()
+	done := make(chan struct{})
+	// 收到 wake 之前每次 sleep 推进虚拟时间，收到后停止
+	g.sleep = func(ctx context.Context, d time.Duration) bool {
+		select {
+		case <-g.wake:
+			cancel()
+			close(done)
+			return false
+		default:
+		}
+		return clock.Sleep(ctx, d)
+	}
+	go g.run(ctx)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("guardian never triggered an immediate detection")
+	}
+
+	if elapsed := clock.Now().Sub(start); elapsed != 15*time.Second {
+		t.Errorf("emergency cycle after %s, want 3 intervals of 5s", elapsed)
+	}
+	if primary.checks != 3 {
+		t.Errorf("%d checks, want 3", primary.checks)
+	}
+}
+
+func TestQueryPrimary(t *testing.T) {
+	savedTimeout := guardianTimeout
+	t.Cleanup(func() { guardianTimeout = savedTimeout })
+	guardianTimeout = 200 * time.Millisecond
+
+	for _, tc := range []struct {
+		name string
+		addr string
+		ok   bool
+	}{
+		{"noerror", dnsServer(t, probe.RcodeSuccess), true},
+		{"nxdomain", dnsServer(t, probe.RcodeNXDomain), true},
+		// 能应答但拒绝或无法解析的首选同样需要换掉
+		{"servfail", dnsServer(t, probe.RcodeServFail), false},
+		{"refused", dnsServer(t, probe.RcodeRefused), false},
+		{"timeout", dnstest.NewServer(t, func([]byte, bool) []byte { return nil }).Addr, false},
+	} {
+		if err := queryPrimary(context.Background(), tc.addr); (err == nil) != tc.ok {
+			t.Errorf("%s: %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+// dnsServer 启动总是以 rcode 应答的假 nameserver，返回地址
+func dnsServer(t *testing.T, rcode int) string {
+	return dnstest.NewServer(t, func(query []byte, tcp bool) []byte {
+		return dnstest.Reply(query, rcode)
+	}).Addr
+}
+
+func TestGuardianSuccessResetsFailures(t *testing.T) {
+	setGuardianFlags(t, time.Second, 2)
+	primary := &fakePrimary{failing: map[string]bool{"10.0.0.1": true}}
+	g := newTestGuardian(newFakeClock(), primary)
+	g.resume("10.0.0.1")
+	ctx := context.Background()
+
+	g.checkOnce(ctx)
+	primary.failing["10.0.0.1"] = false
+	g.checkOnce(ctx)
+	primary.failing["10.0.0.1"] = true
+	g.checkOnce(ctx)
+	select {
+	case <-g.wake:
+		t.Fatal("woke after non-consecutive failures")
+	default:
+	}
+	g.checkOnce(ctx)
+	select {
+	case <-g.wake:
+	default:
+		t.Fatal("no wake after two consecutive failures")
+	}
+}
+
+func TestGuardianPausedAndNewPrimary(t *testing.T) {
+	setGuardianFlags(t, time.Second, 1)
+	primary := &fakePrimary{failing: map[string]bool{"10.0.0.1": true}}
+	g := newTestGuardian(newFakeClock(), primary)
+	ctx := context.Background()
+
+	// 没有首选时不检查
+	g.checkOnce(ctx)
+	if primary.checks != 0 {
+		t.Errorf("%d checks without a primary", primary.checks)
+	}
+
+	// 完整检测期间暂停
+	g.resume("10.0.0.1")
+	g.pause()
+	g.checkOnce(ctx)
+	if primary.checks != 0 {
+		t.Errorf("%d checks while paused", primary.checks)
+	}
+
+	// 检测结束后改为检查新的首选
+	g.resume("10.0.0.2")
+	g.checkOnce(ctx)
+	select {
+	case <-g.wake:
+		t.Fatal("healthy new primary triggered a detection")
+	default:
+	}
+}
+
+func TestCheckConfigGuardianFlags(t *testing.T) {
+	for _, tc := range []struct {
+		interval  time.Duration
+		threshold int
+	}{{0, 3}, {-time.Second, 3}, {time.Second, 0}, {time.Second, -1}} {
+		setGuardianFlags(t, tc.interval, tc.threshold)
+		err := checkConfig()
+		if err == nil || err.code != exitConfig {
+			t.Errorf("interval %s threshold %d: %v, want config error", tc.interval, tc.threshold, err)
+		}
+	}
+	setGuardianFlags(t, time.Second, 1)
+	if err := checkConfig(); err != nil {
+		t.Errorf("valid guardian flags rejected: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"ns-check/internal/probe"
+)
+
+// detectIdentity 查询 nameserver 的 anycast 身份，失败时返回空字符串，不影响检测结果
+func detectIdentity(nameserver string) string {
+	identity, err := probe.Identity(context.Background(), nameserver, nsTimeout)
+	if err != nil {
+		logger.Printf("Nameserver %s identity probe: %v", nameserver, err)
+		return ""
+	}
+	return identity
+}
+
+// limitPerIdentity 在已按延迟排好序的结果中，每个身份最多保留 -max-per-identity 个，
+// 即保留延迟最低的成员；没有身份的 nameserver 不受限制
+func limitPerIdentity(results []latencyResult) []latencyResult {
+	if maxPerIdentity <= 0 {
+		return results
+	}
+	counts := make(map[string]int)
+	limited := make([]latencyResult, 0, len(results))
+	for _, result := range results {
+		if result.identity != "" {
+			if counts[result.identity] >= maxPerIdentity {
+				logger.Printf("Nameserver %s skipped, identity %q already has %d nameservers", result.nameserver, result.identity, maxPerIdentity)
+				continue
+			}
+			counts[result.identity]++
+		}
+		limited = append(limited, result)
+	}
+	return limited
+}
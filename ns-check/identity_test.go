@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"ns-check/internal/dnstest"
+	"ns-check/internal/probe"
+)
+
+// setIdentityFlags 开启身份检测并设置每个身份的上限，测试结束后还原
+func setIdentityFlags(t *testing.T, max int) {
+	t.Helper()
+	savedDetect, savedMax, savedMode := detectAnycastID, maxPerIdentity, probeMode
+	t.Cleanup(func() { detectAnycastID, maxPerIdentity, probeMode = savedDetect, savedMax, savedMode })
+	detectAnycastID, maxPerIdentity, probeMode = true, max, string(probe.ModeTCPConnect)
+}
+
+// identityServer 启动假 nameserver，chaos 非空时通过 id.server 返回身份，
+// 否则 nsid 非空时通过 NSID 返回，都为空时不报告身份，返回服务器地址
+func identityServer(t *testing.T, chaos, nsid string) string {
+	return dnstest.NewServer(t, func(query []byte, tcp bool) []byte {
+		q, err := probe.ParseQuery(query)
+		if err != nil {
+			return nil
+		}
+		if q.Class == probe.ClassCHAOS {
+			if chaos != "" && q.Name == "id.server." {
+				return dnstest.Reply(query, probe.RcodeSuccess, dnstest.TXT(probe.ClassCHAOS, chaos))
+			}
+			return dnstest.Reply(query, probe.RcodeRefused)
+		}
+		resp := dnstest.Reply(query, probe.RcodeSuccess)
+		if nsid != "" {
+			resp = dnstest.WithNSID(resp, nsid)
+		}
+		return resp
+	}).Addr
+}
+
+func TestLimitPerIdentity(t *testing.T) {
+	results := []latencyResult{
+		{nameserver: "10.0.0.1", identity: "pop-a", latency: 1 * time.Millisecond},
+		{nameserver: "10.0.0.2", latency: 2 * time.Millisecond},
+		{nameserver: "10.0.0.3", identity: "pop-a", latency: 3 * time.Millisecond},
+		{nameserver: "10.0.0.4", identity: "pop-b", latency: 4 * time.Millisecond},
+		{nameserver: "10.0.0.5", identity: "pop-a", latency: 5 * time.Millisecond},
+		{nameserver: "10.0.0.6", latency: 6 * time.Millisecond},
+	}
+	names := func(results []latencyResult) []string {
+		var names []string
+		for _, result := range results {
+			names = append(names, result.nameserver)
+		}
+		return names
+	}
+
+	for _, tc := range []struct {
+		max  int
+		want []string
+	}{
+		{0, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}},
+		{1, []string{"10.0.0.1", "10.0.0.2", "10.0.0.4", "10.0.0.6"}},
+		{2, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.6"}},
+	} {
+		setIdentityFlags(t, tc.max)
+		// 每个身份保留延迟最低的成员，没有身份的不受限制
+		if got := names(limitPerIdentity(results)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("max %d: %v, want %v", tc.max, got, tc.want)
+		}
+	}
+}
+
+// TestSortNameserversIdentityCap 通过假服务器走完整的检测和身份查询
+func TestSortNameserversIdentityCap(t *testing.T) {
+	a1 := identityServer(t, "pop-a", "")
+	a2 := identityServer(t, "pop-a", "")
+	b := identityServer(t, "", "pop-b")
+	none := identityServer(t, "", "")
+	setIdentityFlags(t, 1)
+
+	// 最后一个地址没有服务器，检测失败
+	sorted, results, healthy := sortNameservers([]string{a1, a2, b, none, dnstest.Unused(t)})
+
+	identities := make(map[string]string)
+	for _, result := range results {
+		identities[result.nameserver] = result.identity
+	}
+	perIdentity := make(map[string]int)
+	for _, nameserver := range sorted {
+		id, ok := identities[nameserver]
+		if !ok {
+			t.Errorf("%s selected without a result", nameserver)
+		}
+		perIdentity[id]++
+	}
+	// 两个 pop-a 只保留一个，NSID 得到的 pop-b 和没有身份的都保留
+	if want := map[string]int{"pop-a": 1, "pop-b": 1, "": 1}; !reflect.DeepEqual(perIdentity, want) {
+		t.Errorf("selected %v with identities %v, want one per identity", sorted, identities)
+	}
+	// 健康列表包括被身份上限去掉的 nameserver，首选被去掉时不应当作失效
+	want := []string{a1, a2, b, none}
+	sort.Strings(healthy)
+	sort.Strings(want)
+	if !reflect.DeepEqual(healthy, want) {
+		t.Errorf("healthy %v, want %v", healthy, want)
+	}
+	if identities[b] != "pop-b" {
+		t.Errorf("%s identity %q, want pop-b from NSID", b, identities[b])
+	}
+}
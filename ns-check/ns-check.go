@@ -2,18 +2,24 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"math"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sort"
 	"strings"
 	"syscall"
 	"time"
+
+	"ns-check/internal/netutil"
+	"ns-check/internal/probe"
 )
 
 const (
@@ -25,10 +31,16 @@ const (
 	defaultNSTimeout         = 2 * time.Second
 	defaultFetchTimeout      = 2 * time.Second
 	defaultMaxNameservers    = 3
+	defaultGuardianInterval  = 5 * time.Second
+	defaultGuardianTimeout   = time.Second
+	defaultGuardianThreshold = 3
+	defaultShadowInterval    = time.Minute
 )
 
 var (
 	logger            log.Logger
+	configFile        string
+	configErr         error
 	logFile           string
 	resolvConfPath    string
 	endpointURL       string
@@ -39,90 +51,216 @@ var (
 	maxNameservers    int
 	options           = "timeout:1 attempts:1"
 	search            = "localhost"
+	output            string
+	resolvedLinks     string
+	resolvedDomains   string
+	restoreOnExit     bool
+	primaryGuardian   bool
+	guardianInterval  time.Duration
+	guardianTimeout   time.Duration
+	guardianThreshold int
+	shadowQueries     string
+	shadowInterval    time.Duration
+	shadowAffectScore bool
+	detectAnycastID   bool
+	maxPerIdentity    int
+	minWriteInterval  time.Duration
+	probeMode         string
+	probeSamples      int
 
 	httpClient http.Client
+	resolved   *resolvedWriter
+	shadow     *shadowQuerier
+	damper     *writeDamper
 )
 
 type latencyResult struct {
 	err        error
 	nameserver string
 	latency    time.Duration
+	identity   string
 }
 
 func init() {
-	// 解析命令行参数
-	parseFlags()
-	f, err := os.Create(logFile)
+	// 注册命令行参数，在 main 中解析
+	registerFlags()
+}
+
+// setupLogger 创建缺失的日志目录并打开日志文件，启动检查已经确认可以创建
+func setupLogger() {
+	err := os.MkdirAll(filepath.Dir(logFile), 0755)
+	var f *os.File
+	if err == nil {
+		f, err = os.Create(logFile)
+	}
 	if err != nil {
-		log.Panic(err)
+		os.Exit(reportPreflight(os.Stderr, []*preflightError{{exitLog, err, "fix the permissions of the log file or choose a writable -log-file"}}))
 	}
 	logger = *log.New(f, "ns-check", log.Llongfile)
 }
 
 func main() {
+	// 解析命令行参数
+	parseFlags()
+
+	// 子命令
+	switch flag.Arg(0) {
+	case "init":
+		os.Exit(runSetup(flag.Args()[1:], os.Stdin, os.Stdout, os.Stderr))
+	case "validate":
+		os.Exit(runValidate(os.Stdout, os.Stderr))
+	}
+
+	// 启动前检查配置和所有会写入的路径
+	if code := reportPreflight(os.Stderr, preflight()); code != 0 {
+		os.Exit(code)
+	}
+	setupLogger()
+
 	// 监听系统信号，用于优雅地退出
-	setupSignalHandler()
+	ctx := setupSignalHandler()
 
-	// 启动循环检测
-	run()
+	// 启动循环检测，收到信号后返回
+	run(ctx)
 
-	// 等待信号，阻塞主程序
-	waitForSignal()
+	logger.Println("Received termination signal. Exiting...")
+	if restoreOnExit && resolved != nil {
+		resolved.revert()
+	}
 }
 
-func parseFlags() {
+func registerFlags() {
+	flag.StringVar(&configFile, "config", "", "Path to config file, command line flags take precedence")
 	flag.StringVar(&logFile, "log-file", defaultLogFile, "Path to log file")
 	flag.StringVar(&resolvConfPath, "resolv-conf", defaultResolvConfPath, "Path to resolv.conf file")
 	flag.StringVar(&endpointURL, "endpoint-url", defaultEndpointURL, "URL for fetching nameservers if resolv.conf is unavailable")
 	flag.StringVar(&defaultNameserver, "default-nameserver", defaultDefaultNameserver, "Default nameserver fallback")
 	flag.DurationVar(&interval, "interval", defaultInterval, "Interval between each round of detection")
 	flag.DurationVar(&nsTimeout, "ns-check-timeout", defaultNSTimeout, "Timeout for nameserver connectivity check")
+	flag.StringVar(&probeMode, "probe-mode", string(probe.ModeTCPConnect), "Nameserver check mode, tcp-connect, udp-query or dot-handshake")
+	flag.IntVar(&probeSamples, "probe-samples", 1, "Number of checks per nameserver each round, healthy when at least half succeed")
 	flag.DurationVar(&fetchTimeout, "fetch-timeout", defaultNSTimeout, "Timeout for fetch data from endpoint url")
 	flag.IntVar(&maxNameservers, "max-nameservers", defaultMaxNameservers, "Maximum number of nameservers to write back to resolv.conf")
 	flag.StringVar(&options, "options", options, "Options field in resolv.conf")
 	flag.StringVar(&search, "search", search, "Search field in resolv.conf")
+	flag.StringVar(&output, "output", outputResolvConf, "Output mode, resolv.conf or resolved")
+	flag.StringVar(&resolvedLinks, "resolved-links", "", "Per-link candidate nameservers for resolved output, e.g. tun0=10.0.0.1,10.0.0.2;eth0=1.1.1.1")
+	flag.StringVar(&resolvedDomains, "resolved-domains", "", "Per-link domains for resolved output, e.g. tun0=corp.example.com,~corp")
+	flag.BoolVar(&restoreOnExit, "restore-on-exit", false, "Revert modified links on exit in resolved output mode")
+	flag.DurationVar(&minWriteInterval, "min-write-interval", 0, "Minimum interval between two writes of resolv.conf, 0 disables the limit")
+	flag.BoolVar(&primaryGuardian, "primary-guardian", false, "Check the primary nameserver between rounds and detect immediately when it fails")
+	flag.DurationVar(&guardianInterval, "guardian-interval", defaultGuardianInterval, "Interval between primary nameserver checks")
+	flag.DurationVar(&guardianTimeout, "guardian-timeout", defaultGuardianTimeout, "Timeout for a primary nameserver check")
+	flag.IntVar(&guardianThreshold, "guardian-threshold", defaultGuardianThreshold, "Consecutive failed checks before an immediate detection")
+	flag.StringVar(&shadowQueries, "shadow-queries", "", "Comma-separated real query names to send to the primary nameserver, empty disables shadow queries")
+	flag.DurationVar(&shadowInterval, "shadow-interval", defaultShadowInterval, "Interval between shadow queries")
+	flag.BoolVar(&detectAnycastID, "detect-anycast-identity", false, "Query id.server, hostname.bind or NSID to group nameservers of the same anycast service")
+	flag.IntVar(&maxPerIdentity, "max-per-identity", 0, "Maximum number of nameservers with the same identity, 0 means unlimited")
+	flag.BoolVar(&shadowAffectScore, "shadow-affects-score", false, "Demote nameservers whose last shadow query failed")
+}
 
+func parseFlags() {
 	flag.Parse()
-}
 
-func setupSignalHandler() {
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	// 配置文件错误在启动检查中报告
+	if configFile != "" {
+		config, err := loadConfig(configFile)
+		if err == nil {
+			err = applyConfig(config)
+		}
+		configErr = err
+	}
+}
 
-	go func() {
-		<-signalChan
-		logger.Println("Received termination signal. Exiting...")
-		os.Exit(0)
-	}()
+// setupSignalHandler 返回的 ctx 在收到终止信号后结束
+func setupSignalHandler() context.Context {
+	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	return ctx
 }
 
-func run() {
+func run(ctx context.Context) {
 	httpClient = http.Client{
 		Timeout: fetchTimeout,
 	}
+	if output == outputResolved {
+		runResolved(ctx)
+		return
+	}
+	damper = newWriteDamper(minWriteInterval, writeResolvConf)
+	var g *guardian
+	var wake chan struct{}
+	if primaryGuardian {
+		g = newGuardian()
+		wake = g.wake
+		go g.run(ctx)
+	}
+	if names := parseShadowQueries(shadowQueries); len(names) > 0 {
+		shadow = newShadowQuerier(names)
+		go shadow.run(ctx)
+	}
+	// 暂存的变化到期写入后，guardian 和影子查询改用新的首选
+	damper.onFlush = func(written []string) {
+		if g != nil && len(written) > 0 {
+			g.setPrimary(written[0])
+		}
+		if shadow != nil && len(written) > 0 {
+			shadow.setPrimary(written[0])
+		}
+	}
 	for {
-		// 收集nameservers
-		nameservers, err := collectNameservers()
-		logger.Println("Collect nameservers are", nameservers)
-		if err != nil {
-			logger.Println("Failed to collect nameservers:", err)
-			continue
+		if g != nil {
+			g.pause()
+		}
+		runCycle()
+		written := damper.current()
+		if g != nil && len(written) > 0 {
+			g.resume(written[0])
+		}
+		if shadow != nil && len(written) > 0 {
+			shadow.setPrimary(written[0])
 		}
 
-		// 检测并排序nameservers
-		sortedNameservers, latencyResults := sortNameservers(nameservers)
-		bestNameservers := getMaxNameservers(sortedNameservers)
-
-		// 写回resolv.conf
-		err = writeResolvConf(bestNameservers)
-		if err != nil {
-			logger.Println("Failed to write resolv.conf:", err)
+		// 间隔一段时间后再次执行检测，首选 nameserver 失效时提前执行
+		if !netutil.SleepOrWake(ctx, interval, wake) {
+			return
 		}
-		logger.Printf("Nameserver info %#v", latencyResults)
-		logger.Println("Nameserver detection completed, best nameservers are", bestNameservers)
+	}
+}
+
+func runCycle() {
+	// 收集nameservers
+	nameservers, err := collectNameservers()
+	logger.Println("Collect nameservers are", nameservers)
+	if err != nil {
+		logger.Println("Failed to collect nameservers:", err)
+		return
+	}
+
+	// 检测并排序nameservers
+	sortedNameservers, latencyResults, healthy := sortNameservers(nameservers)
+	sortedNameservers = applyShadowScore(sortedNameservers)
+	bestNameservers := getMaxNameservers(sortedNameservers)
+
+	// 写回resolv.conf，受最小写入间隔限制，首选是否健康按截取之前的检测结果判断
+	err = damper.submit(bestNameservers, healthy)
+	if err != nil {
+		logger.Println("Failed to write resolv.conf:", err)
+	}
+	logger.Printf("Nameserver info %#v", latencyResults)
+	logger.Println("Nameserver detection completed, best nameservers are", bestNameservers)
+}
+
+func runResolved(ctx context.Context) {
+	// 启动检查已经校验过
+	mapping, _ := newLinkMapping(resolvedLinks, resolvedDomains)
+	resolved = newResolvedWriter(resolvectlClient{}, mapping)
+	for {
+		resolved.runCycle()
 
 		// 间隔一段时间后再次执行检测
-		time.Sleep(interval)
+		if !netutil.Sleep(ctx, interval) {
+			return
+		}
 	}
 }
 
@@ -141,6 +279,9 @@ func getNameservers(nameserverSet map[string]bool) []string {
 }
 
 func getDefaultNameservers(defaultNameserver string) []string {
+	if defaultNameserver == "" {
+		return nil
+	}
 	return strings.Split(defaultNameserver, ",")
 }
 
@@ -155,14 +296,16 @@ func collectNameservers() ([]string, error) {
 		logger.Println("Collect nameserver from resolv.conf failed:", err)
 	}
 
-	// 从endpointURL获取nameservers
-	lastEndpointURL := endpointURL
-	nameservers, endpointURL, err = fetchNameserversFromEndpoint(endpointURL)
-	if err == nil && len(nameservers) > 0 {
-		logger.Printf("Collect nameservers from endpoint url %s are %v, new endpoint url is %s", lastEndpointURL, nameservers, endpointURL)
-		addNameservers(nameservers, nameserverSet)
-	} else {
-		logger.Println("Collect nameserver from endpoint url failed:", err)
+	// 从endpointURL获取nameservers，为空表示不使用服务端
+	if endpointURL != "" {
+		lastEndpointURL := endpointURL
+		nameservers, endpointURL, err = fetchNameserversFromEndpoint(&httpClient, endpointURL)
+		if err == nil && len(nameservers) > 0 {
+			logger.Printf("Collect nameservers from endpoint url %s are %v, new endpoint url is %s", lastEndpointURL, nameservers, endpointURL)
+			addNameservers(nameservers, nameserverSet)
+		} else {
+			logger.Println("Collect nameserver from endpoint url failed:", err)
+		}
 	}
 
 	defaultNameservers := getDefaultNameservers(defaultNameserver)
@@ -198,12 +341,16 @@ func readNameserversFromResolvConf() ([]string, error) {
 	return nameservers, nil
 }
 
-func fetchNameserversFromEndpoint(url string) ([]string, string, error) {
-	resp, err := httpClient.Get(url)
+func fetchNameserversFromEndpoint(client *http.Client, url string) ([]string, string, error) {
+	resp, err := client.Get(url)
 	if err != nil {
 		return nil, endpointURL, err
 	}
-	defer resp.Body.Close()
+	// 读完响应体再关闭，错误路径上也不会泄漏连接
+	defer netutil.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, endpointURL, fmt.Errorf("unexpected status %s", resp.Status)
+	}
 
 	var data struct {
 		Nameservers []string `json:"nameservers"`
@@ -221,7 +368,9 @@ func fetchNameserversFromEndpoint(url string) ([]string, string, error) {
 	return data.Nameservers, data.EndpointURL, nil
 }
 
-func sortNameservers(nameservers []string) ([]string, []latencyResult) {
+// sortNameservers 返回按延迟排序并按身份截取后的 nameserver 和检测结果，
+// 以及截取之前本轮检测健康的全部 nameserver
+func sortNameservers(nameservers []string) ([]string, []latencyResult, []string) {
 
 	results := make([]latencyResult, 0, len(nameservers))
 	latencyResults := make([]latencyResult, 0)
@@ -231,7 +380,11 @@ func sortNameservers(nameservers []string) ([]string, []latencyResult) {
 	for _, ns := range nameservers {
 		go func(nameserver string) {
 			latency, err := measureLatency(nameserver)
-			resultChan <- latencyResult{err: err, nameserver: nameserver, latency: latency}
+			result := latencyResult{err: err, nameserver: nameserver, latency: latency}
+			if err == nil && detectAnycastID {
+				result.identity = detectIdentity(nameserver)
+			}
+			resultChan <- result
 		}(ns)
 	}
 
@@ -246,6 +399,13 @@ func sortNameservers(nameservers []string) ([]string, []latencyResult) {
 	sort.Slice(results, func(i, j int) bool {
 		return results[i].latency < results[j].latency
 	})
+	healthy := make([]string, 0, len(results))
+	for _, result := range results {
+		healthy = append(healthy, result.nameserver)
+	}
+	if detectAnycastID {
+		results = limitPerIdentity(results)
+	}
 
 	sortedNameservers := make([]string, 0, len(results))
 	for _, result := range results {
@@ -253,7 +413,7 @@ func sortNameservers(nameservers []string) ([]string, []latencyResult) {
 		sortedNameservers = append(sortedNameservers, result.nameserver)
 	}
 
-	return sortedNameservers, latencyResults
+	return sortedNameservers, latencyResults, healthy
 }
 
 func getMaxNameservers(nameservers []string) []string {
@@ -264,15 +424,13 @@ func getMaxNameservers(nameservers []string) []string {
 }
 
 func measureLatency(nameserver string) (time.Duration, error) {
-	startTime := time.Now()
-
-	conn, err := net.DialTimeout("tcp", nameserver+":53", nsTimeout)
-	if err != nil {
-		logger.Printf("Nameserver %s healthy check: %v", nameserver, err)
-		return math.MaxInt64, err
+	result := probe.Measure(context.Background(), probe.Mode(probeMode), nameserver, nsTimeout, probeSamples)
+	if !result.Healthy() {
+		logger.Printf("Nameserver %s healthy check: %d/%d %s probes succeeded: %s", nameserver, result.Successes, result.Samples, result.Mode, result.Err)
+		return math.MaxInt64, errors.New(result.Err)
 	}
-	conn.Close()
-	return time.Since(startTime), nil
+	// 多次探测时按成功率放大延迟，丢包的 nameserver 排在后面
+	return result.Score, nil
 }
 
 func writeResolvConf(nameservers []string) error {
@@ -307,7 +465,3 @@ func writeResolvConf(nameservers []string) error {
 
 	return nil
 }
-
-func waitForSignal() {
-	select {}
-}
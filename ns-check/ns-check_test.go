@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ns-check/internal/netutil"
+)
+
+func TestMain(m *testing.M) {
+	logger = *log.New(io.Discard, "ns-check", log.Llongfile)
+	os.Exit(m.Run())
+}
+
+// fakeClock 虚拟时钟，Sleep 立即返回并把时间向前推进，Advance 时触发到期的定时器
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+// Stop 与 time.Timer 相同，定时器已触发或已停止时返回 false
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	return true
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) stopper {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if !t.stopped && !t.at.After(c.now) {
+			t.stopped = true
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+	// 在锁外回调，回调中可以再创建定时器
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	c.Advance(d)
+	return true
+}
+
+func countFDs(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd:", err)
+	}
+	return len(entries)
+}
+
+// waitStable 等待计数回落到 limit 以内，返回最后一次的值
+func waitStable(count func() int, limit int) int {
+	n := count()
+	for deadline := time.Now().Add(2 * time.Second); n > limit && time.Now().Before(deadline); n = count() {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return n
+}
+
+// TestFetchSoak 对返回成功、错误和超时的 endpoint 快速执行几百轮，FD 和 goroutine 数量不应增长
+func TestFetchSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test")
+	}
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		switch requests.Add(1) % 4 {
+		case 0, 1:
+			http.Error(w, strings.Repeat("error ", 1000), http.StatusInternalServerError)
+		case 2:
+			w.Write([]byte("not json " + strings.Repeat(" ", 1000)))
+		default:
+			w.Write([]byte(`{"nameservers":["10.0.0.1"],"endpointURL":""}`))
+		}
+	}))
+	defer server.Close()
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	savedClient, savedURL := httpClient, endpointURL
+	defer func() { httpClient, endpointURL = savedClient, savedURL }()
+	endpointURL = server.URL
+
+	// 请求超时之后客户端也会关闭连接，只有超时的一轮使用短超时，
+	// 其他轮次泄漏的连接才会在检查时仍然打开
+	i := 0
+	cycle := func() {
+		i++
+		if i%10 == 0 {
+			httpClient = http.Client{Timeout: 20 * time.Millisecond, Transport: transport}
+			fetchNameserversFromEndpoint(&httpClient, server.URL+"/slow")
+		} else {
+			httpClient = http.Client{Timeout: time.Minute, Transport: transport}
+			fetchNameserversFromEndpoint(&httpClient, server.URL)
+		}
+		netutil.Sleep(context.Background(), 0)
+	}
+	// 预热连接池后取基准值
+	for i := 0; i < 20; i++ {
+		cycle()
+	}
+	baseFDs, baseGoroutines := countFDs(t), runtime.NumGoroutine()
+
+	for i := 0; i < 300; i++ {
+		cycle()
+	}
+	const slack = 4
+	if n := waitStable(func() int { return countFDs(t) }, baseFDs+slack); n > baseFDs+slack {
+		t.Errorf("open FDs grew from %d to %d", baseFDs, n)
+	}
+	if n := waitStable(runtime.NumGoroutine, baseGoroutines+slack); n > baseGoroutines+slack {
+		t.Errorf("goroutines grew from %d to %d", baseGoroutines, n)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"ns-check/internal/probe"
+)
+
+// 启动检查失败时的退出码，11 保留给将来的状态文件
+const (
+	exitLog    = 10
+	exitTarget = 12
+	exitConfig = 13
+)
+
+// preflightError 启动检查失败的原因、退出码和处理建议
+type preflightError struct {
+	code int
+	err  error
+	hint string
+}
+
+func (e *preflightError) Error() string {
+	return fmt.Sprintf("%v (hint: %s)", e.err, e.hint)
+}
+
+// preflight 检查配置以及所有会写入的路径，只检查不修改，validate 也可以安全地执行，返回全部失败项
+func preflight() []*preflightError {
+	var failures []*preflightError
+	if err := checkConfig(); err != nil {
+		failures = append(failures, err)
+	}
+	if err := checkLogFile(logFile); err != nil {
+		failures = append(failures, err)
+	}
+	if err := checkTargets(); err != nil {
+		failures = append(failures, err)
+	}
+	return failures
+}
+
+func checkConfig() *preflightError {
+	if configErr != nil {
+		return &preflightError{exitConfig, fmt.Errorf("config file %s: %v", configFile, configErr), "fix the reported line or run \"ns-check init\" to generate a new config file"}
+	}
+	if _, err := probe.ParseMode(probeMode); err != nil {
+		return &preflightError{exitConfig, err, "set -probe-mode to tcp-connect, udp-query or dot-handshake"}
+	}
+	if guardianInterval <= 0 || guardianTimeout <= 0 || guardianThreshold <= 0 {
+		return &preflightError{exitConfig, fmt.Errorf("-guardian-interval %s, -guardian-timeout %s and -guardian-threshold %d must be positive", guardianInterval, guardianTimeout, guardianThreshold), "set them to positive values, a zero interval would query the primary nameserver nonstop"}
+	}
+	if shadowInterval <= 0 {
+		return &preflightError{exitConfig, fmt.Errorf("-shadow-interval %s must be positive", shadowInterval), "shadow queries are rate limited to one per interval, set a positive value such as 1m"}
+	}
+	switch output {
+	case outputResolvConf:
+	case outputResolved:
+		if _, err := newLinkMapping(resolvedLinks, resolvedDomains); err != nil {
+			return &preflightError{exitConfig, err, "set -resolved-links as link=ns1,ns2;link2=ns3"}
+		}
+	default:
+		return &preflightError{exitConfig, fmt.Errorf("unknown output mode %q", output), "set -output to resolv.conf or resolved"}
+	}
+	return nil
+}
+
+// checkLogFile 确认日志文件可写；文件不存在时确认最近的已有上级目录可写，
+// 缺失的目录在启动时由 setupLogger 创建
+func checkLogFile(path string) *preflightError {
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.IsDir() {
+			return &preflightError{exitLog, fmt.Errorf("log file %s is a directory", path), "point -log-file at a file"}
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return &preflightError{exitLog, fmt.Errorf("log file %s is not writable: %v", path, err), "fix the permissions of the log file or choose a writable -log-file"}
+		}
+		f.Close()
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return &preflightError{exitLog, err, "check -log-file"}
+	}
+	dir, err := existingDir(filepath.Dir(path))
+	if err == nil {
+		err = checkWritableDir(dir)
+	}
+	if err != nil {
+		return &preflightError{exitLog, fmt.Errorf("log directory of %s: %v", path, err), "create the directory or choose another -log-file"}
+	}
+	return nil
+}
+
+// existingDir 返回 dir 或它最近的已经存在的上级目录
+func existingDir(dir string) (string, error) {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", dir)
+			}
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, os.ErrNotExist) || parent == dir {
+			return "", err
+		}
+		dir = parent
+	}
+}
+
+// checkWritableDir 在 dir 中创建并删除一个临时文件，确认目录可写
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".ns-check-preflight-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkTargets 确认输出目标可写，resolv.conf 的目录不会被自动创建
+func checkTargets() *preflightError {
+	if output == outputResolved {
+		if _, err := exec.LookPath("resolvectl"); err != nil {
+			return &preflightError{exitTarget, err, "install systemd-resolved or use -output resolv.conf"}
+		}
+		return nil
+	}
+
+	info, err := os.Stat(resolvConfPath)
+	if err == nil {
+		if info.IsDir() {
+			return &preflightError{exitTarget, fmt.Errorf("%s is a directory", resolvConfPath), "point -resolv-conf at a file"}
+		}
+		f, err := os.OpenFile(resolvConfPath, os.O_WRONLY, 0)
+		if err != nil {
+			return &preflightError{exitTarget, fmt.Errorf("%s is not writable: %v", resolvConfPath, err), "run ns-check as root or fix the permissions of -resolv-conf"}
+		}
+		f.Close()
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return &preflightError{exitTarget, err, "check -resolv-conf"}
+	}
+	// 文件不存在时确认目录可写
+	if err := checkWritableDir(filepath.Dir(resolvConfPath)); err != nil {
+		return &preflightError{exitTarget, fmt.Errorf("%s: %v", resolvConfPath, err), "create the directory or fix its permissions"}
+	}
+	return nil
+}
+
+// reportPreflight 每个失败项输出一行，返回第一个失败项的退出码
+func reportPreflight(w io.Writer, failures []*preflightError) int {
+	for _, failure := range failures {
+		fmt.Fprintln(w, "ns-check:", failure)
+	}
+	if len(failures) == 0 {
+		return 0
+	}
+	return failures[0].code
+}
+
+// runValidate 实现 validate 子命令，执行与启动时相同的检查
+func runValidate(stdout, stderr io.Writer) int {
+	code := reportPreflight(stderr, preflight())
+	if code == 0 {
+		fmt.Fprintln(stdout, "ns-check: configuration ok")
+	}
+	return code
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupPreflight 使用临时目录中的日志和 resolv.conf 路径，所有检查都能通过，测试结束后还原
+func setupPreflight(t *testing.T) string {
+	t.Helper()
+	saveFlags(t)
+	savedErr := configErr
+	t.Cleanup(func() { configErr = savedErr })
+	configErr = nil
+
+	dir := t.TempDir()
+	logFile = filepath.Join(dir, "ns-check.log")
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	output = outputResolvConf
+	return dir
+}
+
+// unwritableDir 返回不能创建文件的目录，使用 /proc 是因为 root 也不能在其中创建文件
+func unwritableDir(t *testing.T) string {
+	t.Helper()
+	if _, err := os.Stat("/proc/version"); err != nil {
+		t.Skip("no /proc:", err)
+	}
+	return "/proc"
+}
+
+// fakeResolvectl 在 dir 中放一个 resolvectl 并只使用 dir 作为 PATH
+func fakeResolvectl(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "resolvectl"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+}
+
+func TestPreflightOK(t *testing.T) {
+	dir := setupPreflight(t)
+	var stdout, stderr bytes.Buffer
+	if code := runValidate(&stdout, &stderr); code != 0 {
+		t.Fatalf("validate exit %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "configuration ok") {
+		t.Errorf("stdout %q", stdout.String())
+	}
+
+	// resolved 输出只需要 resolvectl
+	fakeResolvectl(t, t.TempDir())
+	output, resolvedLinks = outputResolved, "tun0=10.0.0.1"
+	if failures := preflight(); len(failures) != 0 {
+		t.Errorf("resolved output: failures %v", failures)
+	}
+	// 检查不存在的 resolv.conf 所在目录时不留下临时文件
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".ns-check-preflight-") {
+			t.Errorf("left %s behind", entry.Name())
+		}
+	}
+}
+
+// TestPreflightMissingLogDirectory 检查不创建缺失的日志目录，启动时才创建
+func TestPreflightMissingLogDirectory(t *testing.T) {
+	dir := setupPreflight(t)
+	logFile = filepath.Join(dir, "var", "log", "ns-check", "ns-check.log")
+	var stdout, stderr bytes.Buffer
+	if code := runValidate(&stdout, &stderr); code != 0 {
+		t.Fatalf("validate exit %d: %s", code, stderr.String())
+	}
+	// validate 是只读检查，目录中不留下任何文件
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("validate left %v in %s", entries, dir)
+	}
+
+	captureLog(t)
+	setupLogger()
+	if _, err := os.Stat(logFile); err != nil {
+		t.Errorf("log file not created at startup: %v", err)
+	}
+}
+
+// TestPreflightExistingLogFile 已有的日志文件检查后内容不变
+func TestPreflightExistingLogFile(t *testing.T) {
+	setupPreflight(t)
+	if err := os.WriteFile(logFile, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if failures := preflight(); len(failures) != 0 {
+		t.Fatalf("failures %v", failures)
+	}
+	if data, _ := os.ReadFile(logFile); string(data) != "old\n" {
+		t.Errorf("log file changed to %q", data)
+	}
+}
+
+func TestPreflightFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(t *testing.T, dir string)
+		code  int
+	}{
+		{"config file error", func(t *testing.T, dir string) {
+			configErr = errors.New("line 3: unknown flag")
+		}, exitConfig},
+		{"unknown probe mode", func(t *testing.T, dir string) {
+			probeMode = "icmp"
+		}, exitConfig},
+		{"unknown output", func(t *testing.T, dir string) {
+			output = "hosts"
+		}, exitConfig},
+		{"bad resolved links", func(t *testing.T, dir string) {
+			fakeResolvectl(t, dir)
+			output, resolvedLinks = outputResolved, "tun0"
+		}, exitConfig},
+		{"log directory under a file", func(t *testing.T, dir string) {
+			os.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+			logFile = filepath.Join(dir, "file", "ns-check.log")
+		}, exitLog},
+		{"log file is a directory", func(t *testing.T, dir string) {
+			logFile = t.TempDir()
+		}, exitLog},
+		{"log file not writable", func(t *testing.T, dir string) {
+			if os.Geteuid() == 0 {
+				t.Skip("file permissions are not enforced for root")
+			}
+			os.WriteFile(logFile, nil, 0444)
+		}, exitLog},
+		{"log directory not writable", func(t *testing.T, dir string) {
+			logFile = filepath.Join(unwritableDir(t), "ns-check.log")
+		}, exitLog},
+		{"resolv.conf is a directory", func(t *testing.T, dir string) {
+			resolvConfPath = t.TempDir()
+		}, exitTarget},
+		{"resolv.conf directory missing", func(t *testing.T, dir string) {
+			resolvConfPath = filepath.Join(dir, "missing", "resolv.conf")
+		}, exitTarget},
+		{"resolv.conf directory not writable", func(t *testing.T, dir string) {
+			resolvConfPath = filepath.Join(unwritableDir(t), "resolv.conf")
+		}, exitTarget},
+		{"resolv.conf not writable", func(t *testing.T, dir string) {
+			if os.Geteuid() == 0 {
+				t.Skip("file permissions are not enforced for root")
+			}
+			os.WriteFile(resolvConfPath, nil, 0444)
+		}, exitTarget},
+		{"resolvectl missing", func(t *testing.T, dir string) {
+			output, resolvedLinks = outputResolved, "tun0=10.0.0.1"
+			t.Setenv("PATH", dir)
+		}, exitTarget},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := setupPreflight(t)
+			tc.setup(t, dir)
+			failures := preflight()
+			if len(failures) != 1 || failures[0].code != tc.code {
+				t.Fatalf("failures %v, want one with exit code %d", failures, tc.code)
+			}
+			if failures[0].hint == "" {
+				t.Error("failure without a hint")
+			}
+			var stdout, stderr bytes.Buffer
+			if code := runValidate(&stdout, &stderr); code != tc.code || stdout.Len() != 0 {
+				t.Errorf("validate exit %d, stdout %q, want %d", code, stdout.String(), tc.code)
+			}
+			if !strings.Contains(stderr.String(), "hint:") {
+				t.Errorf("stderr %q has no hint", stderr.String())
+			}
+		})
+	}
+}
+
+// TestPreflightReportsAll 所有失败项都输出，退出码取第一个
+func TestPreflightReportsAll(t *testing.T) {
+	dir := setupPreflight(t)
+	probeMode = "icmp"
+	logFile = dir
+	resolvConfPath = filepath.Join(dir, "missing", "resolv.conf")
+
+	var stderr bytes.Buffer
+	code := reportPreflight(&stderr, preflight())
+	if code != exitConfig {
+		t.Errorf("exit %d, want %d", code, exitConfig)
+	}
+	if lines := strings.Count(stderr.String(), "\n"); lines != 3 {
+		t.Errorf("%d lines, want 3:\n%s", lines, stderr.String())
+	}
+}
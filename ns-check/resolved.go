@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const (
+	outputResolvConf = "resolv.conf"
+	outputResolved   = "resolved"
+)
+
+// resolvedClient 抽象 systemd-resolved 的按链路配置接口
+type resolvedClient interface {
+	SetLinkDNS(link string, nameservers []string) error
+	SetLinkDomains(link string, domains []string) error
+	RevertLink(link string) error
+}
+
+// resolvectlClient 通过 resolvectl 命令配置 systemd-resolved
+type resolvectlClient struct{}
+
+func (resolvectlClient) SetLinkDNS(link string, nameservers []string) error {
+	return runResolvectl(append([]string{"dns", link}, nameservers...)...)
+}
+
+func (resolvectlClient) SetLinkDomains(link string, domains []string) error {
+	return runResolvectl(append([]string{"domain", link}, domains...)...)
+}
+
+func (resolvectlClient) RevertLink(link string) error {
+	return runResolvectl("revert", link)
+}
+
+func runResolvectl(args ...string) error {
+	out, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvectl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// linkMapping 记录每条链路各自的候选 nameserver 和搜索域
+type linkMapping struct {
+	links       []string
+	nameservers map[string][]string
+	domains     map[string][]string
+}
+
+// parseLinkMap 解析 "tun0=10.0.0.1,10.0.0.2;eth0=8.8.8.8" 格式
+func parseLinkMap(s string) ([]string, map[string][]string, error) {
+	var links []string
+	values := make(map[string][]string)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		link, list, ok := strings.Cut(entry, "=")
+		link = strings.TrimSpace(link)
+		if !ok || link == "" {
+			return nil, nil, fmt.Errorf("invalid link mapping %q, want link=value[,value]", entry)
+		}
+		if _, exists := values[link]; exists {
+			return nil, nil, fmt.Errorf("duplicate link %q in mapping", link)
+		}
+		var items []string
+		for _, item := range strings.Split(list, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		links = append(links, link)
+		values[link] = items
+	}
+	return links, values, nil
+}
+
+func newLinkMapping(linkNameservers, linkDomains string) (*linkMapping, error) {
+	links, nameservers, err := parseLinkMap(linkNameservers)
+	if err != nil {
+		return nil, err
+	}
+	domainLinks, domains, err := parseLinkMap(linkDomains)
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range domainLinks {
+		if _, ok := nameservers[link]; !ok {
+			return nil, fmt.Errorf("link %q has domains but no nameservers", link)
+		}
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no links configured for %s output", outputResolved)
+	}
+	return &linkMapping{links: links, nameservers: nameservers, domains: domains}, nil
+}
+
+// resolvedWriter 按链路写入 systemd-resolved，并记录已修改的链路以便退出时还原
+type resolvedWriter struct {
+	client       resolvedClient
+	mapping      *linkMapping
+	linkExists   func(link string) bool
+	mu           sync.Mutex
+	appliedLinks map[string]bool
+}
+
+func newResolvedWriter(client resolvedClient, mapping *linkMapping) *resolvedWriter {
+	return &resolvedWriter{
+		client:       client,
+		mapping:      mapping,
+		linkExists:   interfaceExists,
+		appliedLinks: make(map[string]bool),
+	}
+}
+
+func interfaceExists(link string) bool {
+	_, err := net.InterfaceByName(link)
+	return err == nil
+}
+
+// selectLink 对单条链路的候选 nameserver 检测排序并截取
+func (w *resolvedWriter) selectLink(link string) ([]string, []latencyResult) {
+	sortedNameservers, latencyResults, _ := sortNameservers(w.mapping.nameservers[link])
+	return getMaxNameservers(sortedNameservers), latencyResults
+}
+
+// apply 依次配置每条链路，单条链路失败不影响其他链路
+func (w *resolvedWriter) apply(link string, nameservers []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.linkExists(link) {
+		// 链路消失（例如 VPN 断开），之前的配置已随链路一起失效
+		delete(w.appliedLinks, link)
+		return fmt.Errorf("link %s not present, skipped", link)
+	}
+	if len(nameservers) == 0 {
+		return fmt.Errorf("link %s has no healthy nameservers, keep current setting", link)
+	}
+	if err := w.client.SetLinkDNS(link, nameservers); err != nil {
+		return err
+	}
+	w.appliedLinks[link] = true
+	if domains, ok := w.mapping.domains[link]; ok {
+		if err := w.client.SetLinkDomains(link, domains); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCycle 对所有链路执行一轮检测和写入
+func (w *resolvedWriter) runCycle() {
+	for _, link := range w.mapping.links {
+		bestNameservers, latencyResults := w.selectLink(link)
+		logger.Printf("Link %s nameserver info %#v", link, latencyResults)
+		if err := w.apply(link, bestNameservers); err != nil {
+			logger.Printf("Failed to set link %s dns: %v", link, err)
+			continue
+		}
+		logger.Printf("Link %s detection completed, best nameservers are %v", link, bestNameservers)
+	}
+}
+
+// revert 还原所有修改过且仍然存在的链路
+func (w *resolvedWriter) revert() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, link := range w.mapping.links {
+		if !w.appliedLinks[link] {
+			continue
+		}
+		delete(w.appliedLinks, link)
+		if !w.linkExists(link) {
+			logger.Printf("Link %s not present, nothing to revert", link)
+			continue
+		}
+		if err := w.client.RevertLink(link); err != nil {
+			logger.Printf("Failed to revert link %s: %v", link, err)
+			continue
+		}
+		logger.Printf("Link %s reverted", link)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeResolved 记录对 systemd-resolved 的调用
+type fakeResolved struct {
+	calls   []string
+	failDNS map[string]bool
+}
+
+func (f *fakeResolved) SetLinkDNS(link string, nameservers []string) error {
+	if f.failDNS[link] {
+		return errors.New("set dns failed")
+	}
+	f.calls = append(f.calls, "dns "+link+" "+strings.Join(nameservers, " "))
+	return nil
+}
+
+func (f *fakeResolved) SetLinkDomains(link string, domains []string) error {
+	f.calls = append(f.calls, "domain "+link+" "+strings.Join(domains, " "))
+	return nil
+}
+
+func (f *fakeResolved) RevertLink(link string) error {
+	f.calls = append(f.calls, "revert "+link)
+	return nil
+}
+
+func TestParseLinkMap(t *testing.T) {
+	links, values, err := parseLinkMap(" tun0 = 10.0.0.1, 10.0.0.2 ;eth0=1.1.1.1;; ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(links, []string{"tun0", "eth0"}) {
+		t.Errorf("links = %v", links)
+	}
+	want := map[string][]string{"tun0": {"10.0.0.1", "10.0.0.2"}, "eth0": {"1.1.1.1"}}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+
+	for _, bad := range []string{"tun0", "=1.1.1.1", "tun0=1.1.1.1;tun0=8.8.8.8"} {
+		if _, _, err := parseLinkMap(bad); err == nil {
+			t.Errorf("parseLinkMap(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestNewLinkMapping(t *testing.T) {
+	mapping, err := newLinkMapping("tun0=10.0.0.1;eth0=1.1.1.1", "tun0=corp.example.com,~corp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mapping.domains["tun0"], []string{"corp.example.com", "~corp"}) {
+		t.Errorf("tun0 domains = %v", mapping.domains["tun0"])
+	}
+	if _, ok := mapping.domains["eth0"]; ok {
+		t.Error("eth0 has domains, want none")
+	}
+
+	if _, err := newLinkMapping("", ""); err == nil {
+		t.Error("empty mapping accepted")
+	}
+	if _, err := newLinkMapping("tun0=10.0.0.1", "wg0=corp"); err == nil {
+		t.Error("domains for a link without nameservers accepted")
+	}
+}
+
+func newTestResolvedWriter(t *testing.T, present map[string]bool) (*resolvedWriter, *fakeResolved) {
+	t.Helper()
+	mapping, err := newLinkMapping("tun0=10.0.0.1;eth0=1.1.1.1", "tun0=corp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeResolved{failDNS: map[string]bool{}}
+	w := newResolvedWriter(client, mapping)
+	w.linkExists = func(link string) bool { return present[link] }
+	return w, client
+}
+
+func TestResolvedApplyPerLink(t *testing.T) {
+	present := map[string]bool{"tun0": true, "eth0": true}
+	w, client := newTestResolvedWriter(t, present)
+
+	if err := w.apply("tun0", []string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.apply("eth0", []string{"1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dns tun0 10.0.0.1", "domain tun0 corp", "dns eth0 1.1.1.1"}
+	if !reflect.DeepEqual(client.calls, want) {
+		t.Errorf("calls = %q, want %q", client.calls, want)
+	}
+
+	// 没有健康的 nameserver 时保持原有设置
+	client.calls = nil
+	if err := w.apply("eth0", nil); err == nil {
+		t.Error("apply without nameservers succeeded")
+	}
+	if len(client.calls) != 0 {
+		t.Errorf("calls = %q, want none", client.calls)
+	}
+
+	// 单条链路失败不影响其他链路已应用的状态
+	client.failDNS["eth0"] = true
+	if err := w.apply("eth0", []string{"1.1.1.1"}); err == nil {
+		t.Error("apply with failing client succeeded")
+	}
+	if !w.appliedLinks["tun0"] {
+		t.Error("tun0 no longer marked applied")
+	}
+}
+
+func TestResolvedRevert(t *testing.T) {
+	present := map[string]bool{"tun0": true, "eth0": true}
+	w, client := newTestResolvedWriter(t, present)
+	w.apply("tun0", []string{"10.0.0.1"})
+	client.calls = nil
+
+	// 只还原修改过的链路
+	w.revert()
+	if want := []string{"revert tun0"}; !reflect.DeepEqual(client.calls, want) {
+		t.Errorf("calls = %q, want %q", client.calls, want)
+	}
+
+	// 已还原的链路不会重复还原
+	client.calls = nil
+	w.revert()
+	if len(client.calls) != 0 {
+		t.Errorf("second revert calls = %q, want none", client.calls)
+	}
+}
+
+func TestResolvedLinkDisappears(t *testing.T) {
+	present := map[string]bool{"tun0": true, "eth0": true}
+	w, client := newTestResolvedWriter(t, present)
+	w.apply("tun0", []string{"10.0.0.1"})
+	w.apply("eth0", []string{"1.1.1.1"})
+	client.calls = nil
+
+	// VPN 断开后跳过该链路，不影响其他链路
+	present["tun0"] = false
+	if err := w.apply("tun0", []string{"10.0.0.1"}); err == nil {
+		t.Error("apply on missing link succeeded")
+	}
+	if err := w.apply("eth0", []string{"1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if w.appliedLinks["tun0"] {
+		t.Error("missing link still marked applied")
+	}
+
+	// 退出时只还原仍然存在的链路
+	client.calls = nil
+	w.revert()
+	if want := []string{"revert eth0"}; !reflect.DeepEqual(client.calls, want) {
+		t.Errorf("calls = %q, want %q", client.calls, want)
+	}
+
+	// 链路被标记为已修改后消失，还原时跳过
+	present["tun0"] = true
+	w.apply("tun0", []string{"10.0.0.1"})
+	present["tun0"] = false
+	client.calls = nil
+	w.revert()
+	if len(client.calls) != 0 {
+		t.Errorf("calls = %q, want none for a vanished link", client.calls)
+	}
+}
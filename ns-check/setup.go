@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConfigPath = "./ns-check.conf"
+	// setupLogFile 生成的配置使用绝对路径，服务的工作目录通常是 /
+	setupLogFile = "/var/log/ns-check/ns-check.log"
+)
+
+// prompter 负责交互式问答，defaults 模式下直接使用默认值
+type prompter struct {
+	in       *bufio.Scanner
+	out      io.Writer
+	defaults bool
+}
+
+// ask 提问并校验答案，校验失败时重新提问
+func (p *prompter) ask(question, def string, validate func(string) error) (string, error) {
+	if p.defaults {
+		return def, nil
+	}
+	for {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+		if !p.in.Scan() {
+			if err := p.in.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		answer := strings.TrimSpace(p.in.Text())
+		if answer == "" {
+			answer = def
+		}
+		if validate == nil {
+			return answer, nil
+		}
+		if err := validate(answer); err != nil {
+			fmt.Fprintln(p.out, "Invalid answer:", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+func validateYesNo(answer string) error {
+	switch strings.ToLower(answer) {
+	case "y", "yes", "n", "no":
+		return nil
+	}
+	return fmt.Errorf("answer yes or no")
+}
+
+func isYes(answer string) bool {
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
+
+// checkEndpoint 实际请求一次 endpoint，确认其可用，使用单独的 client，不影响运行时的设置
+func checkEndpoint(url string) error {
+	client := &http.Client{Timeout: fetchTimeout}
+	nameservers, _, err := fetchNameserversFromEndpoint(client, url)
+	if err != nil {
+		return err
+	}
+	if len(nameservers) == 0 {
+		return fmt.Errorf("endpoint returned no nameservers")
+	}
+	return nil
+}
+
+// runSetup 实现 init 子命令，只生成配置文件，不会修改 resolv.conf
+func runSetup(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	defaults := fs.Bool("defaults", false, "Use default answers without prompting")
+	configPath := fs.String("path", defaultConfigPath, "Path of the generated config file")
+	unit := fs.Bool("systemd-unit", false, "Print a matching systemd unit file to stdout")
+	force := fs.Bool("force", false, "Overwrite an existing config file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	p := &prompter{in: bufio.NewScanner(stdin), out: stderr, defaults: *defaults}
+	config, err := askConfig(p)
+	if err != nil {
+		fmt.Fprintln(stderr, "init:", err)
+		return 1
+	}
+	if *defaults && config["endpoint-url"] != "" {
+		if err := checkEndpoint(config["endpoint-url"]); err != nil {
+			fmt.Fprintf(stderr, "init: warning: endpoint %s is not reachable now: %v\n", config["endpoint-url"], err)
+		}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(*configPath, flags, 0644)
+	if err != nil {
+		fmt.Fprintln(stderr, "init:", err)
+		return 1
+	}
+	names := []string{"endpoint-url", "default-nameserver", "output", "resolv-conf", "resolved-links", "interval", "log-file"}
+	err = writeConfig(file, names, config)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "init:", err)
+		return 1
+	}
+	fmt.Fprintln(stderr, "Config file written to", *configPath)
+
+	if *unit {
+		if err := writeSystemdUnit(stdout, *configPath); err != nil {
+			fmt.Fprintln(stderr, "init:", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func askConfig(p *prompter) (map[string]string, error) {
+	config := make(map[string]string)
+
+	answer, err := p.ask("Endpoint URL for fetching nameservers, or \"none\" for no server", defaultEndpointURL, func(s string) error {
+		if s == "none" {
+			return nil
+		}
+		return checkEndpoint(s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if answer == "none" {
+		answer = ""
+	}
+	config["endpoint-url"] = answer
+
+	answer, err = p.ask("Output mode, resolv.conf or resolved", outputResolvConf, func(s string) error {
+		if s != outputResolvConf && s != outputResolved {
+			return fmt.Errorf("unsupported output mode %q", s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	config["output"] = answer
+
+	if config["output"] == outputResolved {
+		answer, err = p.ask("Per-link nameservers, e.g. tun0=10.0.0.1;eth0=1.1.1.1", "", func(s string) error {
+			_, err := newLinkMapping(s, "")
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		config["resolved-links"] = answer
+	} else {
+		answer, err = p.ask("Path to resolv.conf file", defaultResolvConfPath, nil)
+		if err != nil {
+			return nil, err
+		}
+		config["resolv-conf"] = answer
+	}
+
+	answer, err = p.ask("Interval between each round of detection", defaultInterval.String(), func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("interval must be positive")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	config["interval"] = answer
+
+	answer, err = p.ask("Allow public fallback nameservers ("+defaultDefaultNameserver+")", "yes", validateYesNo)
+	if err != nil {
+		return nil, err
+	}
+	config["default-nameserver"] = ""
+	if isYes(answer) {
+		config["default-nameserver"] = defaultDefaultNameserver
+	}
+
+	answer, err = p.ask("Path to log file", setupLogFile, func(s string) error {
+		if !filepath.IsAbs(s) {
+			return fmt.Errorf("use an absolute path, the service does not run in this directory")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	config["log-file"] = answer
+
+	return config, nil
+}
+
+func writeSystemdUnit(w io.Writer, configPath string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	configPath, err = filepath.Abs(configPath)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `[Unit]
+Description=ns-check nameserver health check
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=%s -config %s
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`, systemdQuote(executable), systemdQuote(configPath))
+	return err
+}
+
+// systemdQuote 把路径转成 ExecStart 中的一个参数，路径中有空格、引号、% 或 $ 时也不会被拆开或替换
+func systemdQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(s)
+	return `"` + s + `"`
+}
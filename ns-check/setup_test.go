@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newNameserversServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"nameservers":["10.0.0.1"],"endpointURL":""}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// saveFlags 换用注册了相同 flag 但没有命令行参数的 FlagSet，测试结束后还原所有 flag 的值
+func saveFlags(t *testing.T) {
+	t.Helper()
+	orig := flag.CommandLine
+	values := make(map[string]string)
+	fs := flag.NewFlagSet(orig.Name(), flag.ContinueOnError)
+	orig.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	flag.CommandLine = fs
+	t.Cleanup(func() {
+		orig.VisitAll(func(f *flag.Flag) {
+			f.Value.Set(values[f.Name])
+		})
+		flag.CommandLine = orig
+	})
+}
+
+func runScriptedSetup(t *testing.T, script string, args ...string) (int, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := runSetup(args, strings.NewReader(script), &stdout, &stderr)
+	return code, stderr.String()
+}
+
+func TestSetupScriptedRoundTrip(t *testing.T) {
+	saveFlags(t)
+	server := newNameserversServer(t)
+	path := filepath.Join(t.TempDir(), "ns-check.conf")
+
+	script := strings.Join([]string{
+		server.URL,
+		"bogus", // 不支持的输出方式，重新提问
+		"resolv.conf",
+		"/tmp/resolv.conf",
+		"-1s", // 非正数间隔，重新提问
+		"10s",
+		"maybe", // 不是 yes/no，重新提问
+		"no",
+		"./ns-check.log", // 相对路径，重新提问
+		"",
+	}, "\n") + "\n"
+	code, stderr := runScriptedSetup(t, script, "-path", path)
+	if code != 0 {
+		t.Fatalf("runSetup = %d, stderr:\n%s", code, stderr)
+	}
+	if n := strings.Count(stderr, "Invalid answer"); n != 4 {
+		t.Errorf("got %d invalid answers, want 4, stderr:\n%s", n, stderr)
+	}
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"endpoint-url":       server.URL,
+		"default-nameserver": "",
+		"output":             outputResolvConf,
+		"resolv-conf":        "/tmp/resolv.conf",
+		"interval":           "10s",
+		"log-file":           setupLogFile,
+	}
+	for name, value := range want {
+		if config[name] != value {
+			t.Errorf("%s = %q, want %q", name, config[name], value)
+		}
+	}
+	if _, ok := config["resolved-links"]; ok {
+		t.Error("resolved-links written for resolv.conf output")
+	}
+
+	if err := applyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if interval != 10*time.Second || resolvConfPath != "/tmp/resolv.conf" || defaultNameserver != "" {
+		t.Errorf("applied interval %s, resolv-conf %s, default-nameserver %q", interval, resolvConfPath, defaultNameserver)
+	}
+}
+
+func TestSetupResolvedAndNoServer(t *testing.T) {
+	saveFlags(t)
+	path := filepath.Join(t.TempDir(), "ns-check.conf")
+	script := "none\nresolved\ntun0\ntun0=10.0.0.1;eth0=1.1.1.1\n\n\n\n"
+	code, stderr := runScriptedSetup(t, script, "-path", path)
+	if code != 0 {
+		t.Fatalf("runSetup = %d, stderr:\n%s", code, stderr)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config["endpoint-url"] != "" || config["output"] != outputResolved || config["resolved-links"] != "tun0=10.0.0.1;eth0=1.1.1.1" {
+		t.Errorf("config = %v", config)
+	}
+	if config["default-nameserver"] != defaultDefaultNameserver {
+		t.Errorf("default-nameserver = %q, want the public fallback", config["default-nameserver"])
+	}
+	if _, ok := config["resolv-conf"]; ok {
+		t.Error("resolv-conf written for resolved output")
+	}
+}
+
+func TestSetupRejectsUnreachableEndpoint(t *testing.T) {
+	saveFlags(t)
+	savedClient := httpClient
+	t.Cleanup(func() { httpClient = savedClient })
+	httpClient = http.Client{Timeout: time.Minute}
+	fetchTimeout = time.Second
+	server := newNameserversServer(t)
+	path := filepath.Join(t.TempDir(), "ns-check.conf")
+	script := "http://127.0.0.1:1/nameservers\n" + server.URL + "\n\n\n\n\n\n"
+	code, stderr := runScriptedSetup(t, script, "-path", path)
+	if code != 0 {
+		t.Fatalf("runSetup = %d, stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(stderr, "Invalid answer") {
+		t.Errorf("unreachable endpoint accepted, stderr:\n%s", stderr)
+	}
+	// 检查 endpoint 不修改运行时使用的 client
+	if httpClient.Timeout != time.Minute {
+		t.Errorf("init changed the fetch client timeout to %s", httpClient.Timeout)
+	}
+}
+
+func TestWriteSystemdUnit(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeSystemdUnit(&buf, "/etc/ns check/100%.conf"); err != nil {
+		t.Fatal(err)
+	}
+	// 路径中的空格不会拆开参数，% 不会被当作 systemd 的替换符
+	want := "ExecStart=" + systemdQuote(executable) + ` -config "/etc/ns check/100%%.conf"` + "\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("unit:\n%s\nwant line %q", buf.String(), want)
+	}
+	if got := systemdQuote(`/opt/a "b"\$HOME`); got != `"/opt/a \"b\"\\$$HOME"` {
+		t.Errorf("systemdQuote = %s", got)
+	}
+}
+
+func TestSetupExistingFile(t *testing.T) {
+	saveFlags(t)
+	path := filepath.Join(t.TempDir(), "ns-check.conf")
+	if err := os.WriteFile(path, []byte("interval = 5s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := runScriptedSetup(t, "", "-defaults", "-path", path); code != 1 {
+		t.Errorf("runSetup over an existing file = %d, want 1", code)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "interval = 5s\n" {
+		t.Errorf("existing file changed to %q", data)
+	}
+
+	if code, stderr := runScriptedSetup(t, "", "-defaults", "-force", "-path", path); code != 0 {
+		t.Fatalf("runSetup -force = %d, stderr:\n%s", code, stderr)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config["interval"] != defaultInterval.String() || config["endpoint-url"] != defaultEndpointURL {
+		t.Errorf("config = %v, want defaults", config)
+	}
+}
+
+func TestSetupEndOfInput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ns-check.conf")
+	if code, _ := runScriptedSetup(t, "", "-path", path); code != 1 {
+		t.Errorf("runSetup without input = %d, want 1", code)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("config file written without answers")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ns-check.conf")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# comment\n\n interval = 15s \nsearch = a b\n")
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config["interval"] != "15s" || config["search"] != "a b" || len(config) != 2 {
+		t.Errorf("config = %v", config)
+	}
+
+	for _, bad := range []string{"interval 15s\n", "no-such-flag = 1\n", "config = other.conf\n", "= 1\n"} {
+		write(bad)
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("loadConfig(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestApplyConfigCommandLineWins(t *testing.T) {
+	saveFlags(t)
+	if err := flag.CommandLine.Parse([]string{"-interval", "20s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(map[string]string{"interval": "30s", "search": "corp"}); err != nil {
+		t.Fatal(err)
+	}
+	if interval != 20*time.Second || search != "corp" {
+		t.Errorf("interval = %s, search = %q, want command line interval and config search", interval, search)
+	}
+}
+
+func TestApplyConfigInvalidValue(t *testing.T) {
+	saveFlags(t)
+	if err := applyConfig(map[string]string{"interval": "soon"}); err == nil {
+		t.Error("invalid duration accepted")
+	}
+}
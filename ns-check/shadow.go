@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"ns-check/internal/netutil"
+	"ns-check/internal/probe"
+)
+
+// shadowResult 记录一次影子查询的结果，与探测结果分开保存
+type shadowResult struct {
+	name       string
+	nameserver string
+	rcode      int
+	answers    int
+	latency    time.Duration
+	err        error
+	at         time.Time
+}
+
+// shadowKey 影子查询结果按 nameserver 和域名分别保存，
+// 降级后不再被查询的 nameserver 的失败不会被其他 nameserver 的成功覆盖
+type shadowKey struct {
+	nameserver string
+	name       string
+}
+
+// shadowFailureIntervals 失败结果的有效期为多少个 -shadow-interval，
+// 过期后被降级的 nameserver 恢复原有顺序，重新成为首选时再次检查
+const shadowFailureIntervals = 10
+
+func (r shadowResult) failed() bool {
+	return r.err != nil || r.rcode == probe.RcodeServFail || r.rcode == probe.RcodeRefused
+}
+
+// shadowQuerier 以较低频率对首选 nameserver 发送真实业务域名的查询，
+// 用于发现合成探测发现不了的问题
+type shadowQuerier struct {
+	names   []string
+	mu      sync.Mutex
+	primary string
+	next    int
+	last    map[shadowKey]shadowResult
+	query   func(ctx context.Context, nameserver, name string) shadowResult
+	sleep   func(ctx context.Context, d time.Duration) bool
+	now     func() time.Time
+}
+
+func newShadowQuerier(names []string) *shadowQuerier {
+	return &shadowQuerier{
+		names: names,
+		last:  make(map[shadowKey]shadowResult),
+		query: shadowQuery,
+		sleep: netutil.Sleep,
+		now:   time.Now,
+	}
+}
+
+func parseShadowQueries(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func shadowQuery(ctx context.Context, nameserver, name string) shadowResult {
+	result := shadowResult{name: name, nameserver: nameserver}
+	resp, latency, err := probe.Query(ctx, nameserver, name, probe.TypeA, probe.ClassINET, nsTimeout)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.rcode = resp.Rcode
+	result.answers = len(resp.Answers)
+	result.latency = latency
+	return result
+}
+
+func (s *shadowQuerier) setPrimary(primary string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.primary = primary
+}
+
+// run 每个 -shadow-interval 只发送一个查询，按顺序轮流使用各个域名
+func (s *shadowQuerier) run(ctx context.Context) {
+	for s.sleep(ctx, shadowInterval) {
+		s.queryOnce(ctx)
+	}
+}
+
+// queryOnce 用下一个域名查询一次首选 nameserver，失败时输出单独的警告
+func (s *shadowQuerier) queryOnce(ctx context.Context) {
+	s.mu.Lock()
+	primary, name := s.primary, s.names[s.next%len(s.names)]
+	s.next++
+	s.mu.Unlock()
+	if primary == "" {
+		return
+	}
+
+	result := s.query(ctx, primary, name)
+	result.at = s.now()
+	s.mu.Lock()
+	s.last[shadowKey{primary, name}] = result
+	s.mu.Unlock()
+	if result.failed() {
+		logger.Printf("Shadow query warning: %s via %s failed, rcode %d, error %v", name, primary, result.rcode, result.err)
+		return
+	}
+	logger.Printf("Shadow query %s via %s rcode %d, %d answers in %v", name, primary, result.rcode, result.answers, result.latency)
+}
+
+// failingNameservers 返回有域名最近一次影子查询失败且未过期的 nameserver
+func (s *shadowQuerier) failingNameservers() map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failing := make(map[string]bool)
+	expired := s.now().Add(-shadowFailureIntervals * shadowInterval)
+	for key, result := range s.last {
+		if !result.at.After(expired) {
+			delete(s.last, key)
+			continue
+		}
+		if result.failed() {
+			failing[key.nameserver] = true
+		}
+	}
+	return failing
+}
+
+// applyShadowScore 打开 -shadow-affects-score 时降级影子查询失败的 nameserver
+func applyShadowScore(nameservers []string) []string {
+	if shadow == nil || !shadowAffectScore {
+		return nameservers
+	}
+	return demoteNameservers(nameservers, shadow.failingNameservers())
+}
+
+// demoteNameservers 把影子查询失败的 nameserver 移到末尾，其余顺序不变
+func demoteNameservers(nameservers []string, failing map[string]bool) []string {
+	if len(failing) == 0 {
+		return nameservers
+	}
+	result := make([]string, 0, len(nameservers))
+	var demoted []string
+	for _, ns := range nameservers {
+		if failing[ns] {
+			demoted = append(demoted, ns)
+			continue
+		}
+		result = append(result, ns)
+	}
+	return append(result, demoted...)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ns-check/internal/probe"
+)
+
+// captureLog 把 logger 的输出写入返回的 buffer，测试结束后丢弃输出
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger = *log.New(&buf, "ns-check", 0)
+	t.Cleanup(func() { logger = *log.New(io.Discard, "ns-check", log.Llongfile) })
+	return &buf
+}
+
+// fakeShadow 按 nameserver 返回预设的影子查询结果并记录每次查询
+type fakeShadow struct {
+	mu      sync.Mutex
+	results map[string]shadowResult
+	queries []string
+}
+
+func (f *fakeShadow) query(ctx context.Context, nameserver, name string) shadowResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, name+"@"+nameserver)
+	result := f.results[nameserver]
+	result.name, result.nameserver = name, nameserver
+	return result
+}
+
+func TestShadowRateLimited(t *testing.T) {
+	savedInterval := shadowInterval
+	defer func() { shadowInterval = savedInterval }()
+	shadowInterval = time.Minute
+
+	clock := newFakeClock()
+	fake := &fakeShadow{results: map[string]shadowResult{}}
+	s := newShadowQuerier([]string{"a.example.com", "b.example.com"})
+	s.query = fake.query
+	s.setPrimary("10.0.0.1")
+
+	// 每次 sleep 推进一个间隔，第 5 次 sleep 后停止
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sleeps := 0
+	var queriesPerSleep []int
+	s.sleep = func(ctx context.Context, d time.Duration) bool {
+		fake.mu.Lock()
+		queriesPerSleep = append(queriesPerSleep, len(fake.queries))
+		fake.mu.Unlock()
+		if sleeps++; sleeps > 4 {
+			return false
+		}
+		return clock.Sleep(ctx, d)
+	}
+	start := clock.Now()
+	s.run(ctx)
+
+	// 每个间隔只发送一个查询，按顺序轮流使用各个域名
+	if want := []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(queriesPerSleep, want) {
+		t.Errorf("queries before each sleep %v, want %v", queriesPerSleep, want)
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != 4*time.Minute {
+		t.Errorf("4 queries took %s of virtual time, want 4m", elapsed)
+	}
+	want := []string{"a.example.com@10.0.0.1", "b.example.com@10.0.0.1", "a.example.com@10.0.0.1", "b.example.com@10.0.0.1"}
+	if !reflect.DeepEqual(fake.queries, want) {
+		t.Errorf("queries %v, want %v", fake.queries, want)
+	}
+}
+
+func TestShadowNoPrimary(t *testing.T) {
+	fake := &fakeShadow{}
+	s := newShadowQuerier([]string{"a.example.com"})
+	s.query = fake.query
+	s.queryOnce(context.Background())
+	if len(fake.queries) != 0 {
+		t.Errorf("queried %v without a primary", fake.queries)
+	}
+}
+
+func TestShadowDistinctWarning(t *testing.T) {
+	buf := captureLog(t)
+	fake := &fakeShadow{results: map[string]shadowResult{
+		"10.0.0.1": {rcode: probe.RcodeSuccess, answers: 2, latency: time.Millisecond},
+		"10.0.0.2": {rcode: probe.RcodeServFail},
+		"10.0.0.3": {rcode: probe.RcodeRefused},
+		"10.0.0.4": {err: errors.New("i/o timeout")},
+		"10.0.0.5": {rcode: probe.RcodeNXDomain},
+	}}
+	s := newShadowQuerier([]string{"a.example.com"})
+	s.query = fake.query
+
+	for _, tc := range []struct {
+		nameserver string
+		warning    bool
+	}{
+		{"10.0.0.1", false},
+		{"10.0.0.2", true},
+		{"10.0.0.3", true},
+		{"10.0.0.4", true},
+		{"10.0.0.5", false},
+	} {
+		buf.Reset()
+		s.setPrimary(tc.nameserver)
+		s.queryOnce(context.Background())
+		line := buf.String()
+		if got := strings.Contains(line, "Shadow query warning"); got != tc.warning {
+			t.Errorf("%s: warning %v, want %v, log %q", tc.nameserver, got, tc.warning, line)
+		}
+		if !strings.Contains(line, tc.nameserver) {
+			t.Errorf("%s: log %q does not name the nameserver", tc.nameserver, line)
+		}
+	}
+}
+
+func TestShadowAffectsScore(t *testing.T) {
+	savedShadow, savedAffect := shadow, shadowAffectScore
+	defer func() { shadow, shadowAffectScore = savedShadow, savedAffect }()
+
+	fake := &fakeShadow{results: map[string]shadowResult{"10.0.0.1": {rcode: probe.RcodeServFail}}}
+	shadow = newShadowQuerier([]string{"a.example.com"})
+	shadow.query = fake.query
+	shadow.setPrimary("10.0.0.1")
+	shadow.queryOnce(context.Background())
+	sorted := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+
+	// 默认只记录，不影响选择
+	shadowAffectScore = false
+	if got := applyShadowScore(sorted); !reflect.DeepEqual(got, sorted) {
+		t.Errorf("score off: %v, want unchanged %v", got, sorted)
+	}
+
+	shadowAffectScore = true
+	if got, want := applyShadowScore(sorted), []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("score on: %v, want %v", got, want)
+	}
+
+	// 最近一次查询成功后恢复原有顺序
+	fake.results["10.0.0.1"] = shadowResult{rcode: probe.RcodeSuccess, answers: 1}
+	shadow.queryOnce(context.Background())
+	if got := applyShadowScore(sorted); !reflect.DeepEqual(got, sorted) {
+		t.Errorf("after recovery: %v, want %v", got, sorted)
+	}
+
+	// 没有影子查询时不变
+	shadow = nil
+	if got := applyShadowScore(sorted); !reflect.DeepEqual(got, sorted) {
+		t.Errorf("no shadow querier: %v, want %v", got, sorted)
+	}
+}
+
+// TestShadowDemotionSticks 降级后换了首选，新首选对同一域名的成功不会让原首选恢复
+func TestShadowDemotionSticks(t *testing.T) {
+	savedShadow, savedAffect, savedInterval := shadow, shadowAffectScore, shadowInterval
+	defer func() { shadow, shadowAffectScore, shadowInterval = savedShadow, savedAffect, savedInterval }()
+	shadowAffectScore, shadowInterval = true, time.Minute
+
+	clock := newFakeClock()
+	fake := &fakeShadow{results: map[string]shadowResult{
+		"10.0.0.1": {rcode: probe.RcodeServFail},
+		"10.0.0.2": {rcode: probe.RcodeSuccess, answers: 1},
+	}}
+	shadow = newShadowQuerier([]string{"a.example.com"})
+	shadow.query, shadow.now = fake.query, clock.Now
+	sorted := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	demoted := []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"}
+
+	// 每轮按影子查询结果选出首选，再向首选发送一次查询
+	primary := sorted[0]
+	for cycle := 0; cycle < 3; cycle++ {
+		shadow.setPrimary(primary)
+		shadow.queryOnce(context.Background())
+		clock.Advance(shadowInterval)
+		got := applyShadowScore(sorted)
+		if !reflect.DeepEqual(got, demoted) {
+			t.Fatalf("cycle %d: %v, want %v", cycle, got, demoted)
+		}
+		primary = got[0]
+	}
+
+	// 失败结果过期后恢复原有顺序
+	clock.Advance(shadowFailureIntervals * shadowInterval)
+	if got := applyShadowScore(sorted); !reflect.DeepEqual(got, sorted) {
+		t.Errorf("after expiry: %v, want %v", got, sorted)
+	}
+}
+
+func TestCheckConfigShadowInterval(t *testing.T) {
+	savedInterval := shadowInterval
+	defer func() { shadowInterval = savedInterval }()
+	for _, d := range []time.Duration{0, -time.Second} {
+		shadowInterval = d
+		if err := checkConfig(); err == nil || err.code != exitConfig {
+			t.Errorf("-shadow-interval %s: %v, want config error", d, err)
+		}
+	}
+	shadowInterval = time.Second
+	if err := checkConfig(); err != nil {
+		t.Errorf("valid -shadow-interval rejected: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	templateBareArray = "bare-array"
+	templateV1        = "v1"
+	templatePlaintext = "plaintext"
+)
+
+// compatEndpoint 为旧版客户端提供的兼容接口
+type compatEndpoint struct {
+	path     string
+	template string
+	ttl      time.Duration
+	rendered atomic.Value
+}
+
+// compatEndpoints 实现 flag.Value，每个 -compat-endpoint 参数为 path=template[,ttl]
+type compatEndpoints []*compatEndpoint
+
+func (c *compatEndpoints) String() string {
+	var values []string
+	for _, e := range *c {
+		values = append(values, e.path+"="+e.template)
+	}
+	return strings.Join(values, " ")
+}
+
+func (c *compatEndpoints) Set(value string) error {
+	path, spec, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("want /path=template[,ttl], got %q", value)
+	}
+	template, ttlValue, hasTTL := strings.Cut(spec, ",")
+	switch template {
+	case templateBareArray, templateV1, templatePlaintext:
+	default:
+		return fmt.Errorf("unknown template %q, want %s, %s or %s", template, templateBareArray, templateV1, templatePlaintext)
+	}
+	e := &compatEndpoint{path: path, template: template}
+	if hasTTL {
+		ttl, err := time.ParseDuration(ttlValue)
+		if err != nil {
+			return err
+		}
+		if ttl < 0 {
+			return fmt.Errorf("negative ttl %s", ttl)
+		}
+		e.ttl = ttl
+	}
+	*c = append(*c, e)
+	return nil
+}
+
+// validateCompatEndpoints 拒绝与核心接口、租户接口或彼此冲突的路径，
+// 以 / 结尾的路径在 ServeMux 中会匹配整个子树，同样拒绝
+func validateCompatEndpoints(endpoints compatEndpoints) error {
+	seen := map[string]bool{endpoint: true, healthPath: true}
+	for _, e := range endpoints {
+		if strings.HasSuffix(e.path, "/") {
+			return fmt.Errorf("compat endpoint %s would match every path below it, remove the trailing slash", e.path)
+		}
+		if seen[e.path] || strings.HasPrefix(e.path, tenantPrefix) {
+			return fmt.Errorf("compat endpoint %s collides with an existing route", e.path)
+		}
+		seen[e.path] = true
+	}
+	return nil
+}
+
+// renderCompat 按模板渲染兼容接口的响应
+func renderCompat(e *compatEndpoint, response NameserversResponse) (*renderedResponse, error) {
+	switch e.template {
+	case templateBareArray:
+		return renderJSON(response.Nameservers)
+	case templateV1:
+		return renderJSON(struct {
+			Nameservers []string `json:"nameservers"`
+			EndpointURL string   `json:"endpointURL"`
+		}{response.Nameservers, response.EndpointURL})
+	default:
+		body := strings.Join(response.Nameservers, "\n") + "\n"
+		return newRenderedResponse([]byte(body), "text/plain; charset=utf-8"), nil
+	}
+}
+
+func (e *compatEndpoint) handler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s send a request to compat endpoint %s", r.RemoteAddr, e.path)
+	if e.ttl > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(e.ttl.Seconds())))
+	}
+	serveRendered(w, r, e.rendered.Load().(*renderedResponse))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func parseCompats(t *testing.T, values ...string) compatEndpoints {
+	t.Helper()
+	var endpoints compatEndpoints
+	for _, value := range values {
+		if err := endpoints.Set(value); err != nil {
+			t.Fatalf("Set(%q): %v", value, err)
+		}
+	}
+	return endpoints
+}
+
+func TestCompatEndpointSet(t *testing.T) {
+	endpoints := parseCompats(t, "/dns/list.json=bare-array,60s", "/v1=v1")
+	if endpoints[0].ttl.Seconds() != 60 || endpoints[1].ttl != 0 {
+		t.Errorf("ttls %s and %s", endpoints[0].ttl, endpoints[1].ttl)
+	}
+	for _, bad := range []string{"dns=v1", "/dns", "/dns=json", "/dns=v1,soon", "/dns=v1,-1s"} {
+		var e compatEndpoints
+		if err := e.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestValidateCompatEndpoints(t *testing.T) {
+	saved := endpoint
+	t.Cleanup(func() { endpoint = saved })
+	endpoint = "/nameservers"
+	if err := validateCompatEndpoints(parseCompats(t, "/dns/list.json=bare-array", "/list.txt=plaintext")); err != nil {
+		t.Errorf("valid endpoints rejected: %v", err)
+	}
+	for _, bad := range [][]string{
+		{"/=bare-array"},
+		{"/dns/=bare-array"},
+		{"/nameservers=v1"},
+		{healthPath + "=v1"},
+		{"/t/teamA/nameservers=v1"},
+		{"/list=v1", "/list=plaintext"},
+	} {
+		if err := validateCompatEndpoints(parseCompats(t, bad...)); err == nil {
+			t.Errorf("%v accepted, want error", bad)
+		}
+	}
+}
+
+func get(t *testing.T, url string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// TestCompatLegacyClient 模拟只认识 JSON 数组的旧客户端，核心接口的响应保持不变
+func TestCompatLegacyClient(t *testing.T) {
+	setupTestServer(t, "1.1.1.1,8.8.8.8")
+	canonical := allTenants[0].rendered.Load().(*renderedResponse).body
+
+	compats = parseCompats(t, "/dns/list.json=bare-array,60s", "/dns/list.txt=plaintext")
+	if err := validateCompatEndpoints(compats); err != nil {
+		t.Fatal(err)
+	}
+	if err := renderAll(); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, body := get(t, server.URL+"/dns/list.json")
+	var list []string
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatalf("legacy client can't decode %q: %v", body, err)
+	}
+	if !reflect.DeepEqual(list, []string{"1.1.1.1", "8.8.8.8"}) {
+		t.Errorf("bare array = %v", list)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=60" {
+		t.Errorf("Cache-Control = %q, want max-age=60", cc)
+	}
+
+	if _, body := get(t, server.URL+"/dns/list.txt"); string(body) != "1.1.1.1\n8.8.8.8\n" {
+		t.Errorf("plaintext = %q", body)
+	}
+
+	resp, body = get(t, server.URL+"/nameservers")
+	if string(body) != string(canonical) || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("canonical endpoint changed to %q (%s), want %q", body, resp.Header.Get("Content-Type"), canonical)
+	}
+
+	// 兼容接口不会接管其他路径
+	if resp, _ := get(t, server.URL+"/dns/other"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path status %d, want 404", resp.StatusCode)
+	}
+}
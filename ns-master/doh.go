@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ns-check/internal/probe"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+	// dohMaxMessageSize 查询报文的最大长度，超过时返回 413
+	dohMaxMessageSize = 4096
+	// dohMaxClients 限速表超过该数量时清理已经回满的客户端
+	dohMaxClients = 10000
+	// dohMaxNegativeTTL 否定响应最长缓存 3 小时（RFC 2308）
+	dohMaxNegativeTTL = 3 * 60 * 60
+)
+
+// dohUpstreams 默认租户当前返回的 nameserver 列表，随 renderAll 更新
+var dohUpstreams atomic.Value
+
+// validateDoHFlags 校验 DoH 相关参数
+func validateDoHFlags() error {
+	if (dohCert == "") != (dohKey == "") {
+		return errors.New("-doh-cert and -doh-key must be given together")
+	}
+	if dohTimeout <= 0 || dohRate < 0 || dohCacheSize < 0 {
+		return errors.New("-doh-timeout must be positive, -doh-rate and -doh-cache-size must not be negative")
+	}
+	if _, err := parseTrustedProxies(dohTrustedProxies); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseTrustedProxies 解析逗号分隔的 IP 或 CIDR
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			_, ipNet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, fmt.Errorf("-doh-trusted-proxies: %v", err)
+			}
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return nil, fmt.Errorf("-doh-trusted-proxies: invalid IP %q", item)
+		}
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// dohForwarder 把 DoH 查询按排名依次转发给上游 nameserver，不做任何递归解析
+type dohForwarder struct {
+	cache          *dnsCache
+	limiter        *rateLimiter
+	trustedProxies []*net.IPNet
+}
+
+func newDoHForwarder() *dohForwarder {
+	// 启动时已经校验过
+	trusted, _ := parseTrustedProxies(dohTrustedProxies)
+	return &dohForwarder{
+		cache:          newDNSCache(dohCacheSize),
+		limiter:        newRateLimiter(dohRate),
+		trustedProxies: trusted,
+	}
+}
+
+// serve 在 ln 上提供 DoH 服务，配置了证书时使用 TLS
+func (f *dohForwarder) serve(server *http.Server, ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, f.handler)
+	server.Handler = mux
+	if dohCert != "" {
+		return server.ServeTLS(ln, dohCert, dohKey)
+	}
+	return server.Serve(ln)
+}
+
+func (f *dohForwarder) handler(w http.ResponseWriter, r *http.Request) {
+	if !f.limiter.allow(f.clientIP(r)) {
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	query, status := readDoHQuery(w, r)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	question, err := probe.ParseQuery(query)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	id := binary.BigEndian.Uint16(query)
+	msg, ttl, ok := f.cache.get(question, id)
+	if !ok {
+		var resp *probe.Response
+		msg, resp, err = f.forward(r.Context(), query)
+		if err != nil {
+			log.Printf("%s DoH query %s type %d failed: %v", r.RemoteAddr, question.Name, question.Type, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		var cacheable bool
+		if ttl, cacheable = minTTL(resp); cacheable {
+			f.cache.put(question, msg, ttl)
+		}
+		binary.BigEndian.PutUint16(msg, id)
+	}
+	// 缓存和上游的响应都换成客户端查询的问题段，域名大小写与查询一致
+	if err := probe.CopyQuestion(msg, query); err != nil {
+		log.Printf("%s DoH query %s type %d failed: %v", r.RemoteAddr, question.Name, question.Type, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	writeDoHResponse(w, msg, ttl)
+}
+
+// clientIP 返回限速使用的客户端 IP。连接来自可信代理时，从右向左取
+// X-Forwarded-For 中第一个不是可信代理的地址，否则使用连接的地址
+func (f *dohForwarder) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !f.trusted(host) {
+		return host
+	}
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// 无法解析的地址不可信，使用添加它的代理
+			return host
+		}
+		if host = hop; !f.trusted(hop) {
+			return hop
+		}
+	}
+	return host
+}
+
+func (f *dohForwarder) trusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range f.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readDoHQuery 读取 GET 的 dns 参数或 POST 的报文，失败时返回对应的状态码
+func readDoHQuery(w http.ResponseWriter, r *http.Request) ([]byte, int) {
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest
+		}
+		if base64.RawURLEncoding.DecodedLen(len(param)) > dohMaxMessageSize {
+			return nil, http.StatusRequestEntityTooLarge
+		}
+		query, err := base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			return nil, http.StatusBadRequest
+		}
+		return query, http.StatusOK
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			return nil, http.StatusUnsupportedMediaType
+		}
+		query, err := io.ReadAll(http.MaxBytesReader(w, r.Body, dohMaxMessageSize))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				return nil, http.StatusRequestEntityTooLarge
+			}
+			return nil, http.StatusBadRequest
+		}
+		return query, http.StatusOK
+	default:
+		return nil, http.StatusMethodNotAllowed
+	}
+}
+
+func writeDoHResponse(w http.ResponseWriter, msg []byte, ttl uint32) {
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	w.Write(msg)
+}
+
+// forward 按排名依次查询上游，出错、SERVFAIL 或 REFUSED 时换下一个，
+// 全部失败时返回最后收到的响应，一个响应都没有时返回错误
+func (f *dohForwarder) forward(ctx context.Context, query []byte) ([]byte, *probe.Response, error) {
+	upstreams, _ := dohUpstreams.Load().([]string)
+	if len(upstreams) == 0 {
+		return nil, nil, errors.New("no upstream nameservers")
+	}
+	// 使用不可预测的随机 ID 查询上游，DoH 客户端通常把 ID 设为 0
+	upstreamQuery := append([]byte{}, query...)
+	if _, err := rand.Read(upstreamQuery[:2]); err != nil {
+		return nil, nil, err
+	}
+
+	var lastMsg []byte
+	var lastResp *probe.Response
+	var lastErr error
+	for _, ns := range upstreams {
+		msg, resp, _, err := probe.ExchangeRaw(ctx, ns, upstreamQuery, dohTimeout)
+		if err == nil {
+			// 不接受问题与查询不同的响应
+			err = probe.CopyQuestion(msg, upstreamQuery)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", ns, err)
+			continue
+		}
+		if resp.Rcode == probe.RcodeServFail || resp.Rcode == probe.RcodeRefused {
+			lastMsg, lastResp = msg, resp
+			continue
+		}
+		return msg, resp, nil
+	}
+	if lastMsg != nil {
+		return lastMsg, lastResp, nil
+	}
+	return nil, nil, lastErr
+}
+
+// minTTL 返回响应可以缓存的时间，即应答中最小的 TTL。NXDOMAIN 和没有应答的 NOERROR
+// 是否定响应，按 RFC 2308 还要取授权段 SOA 的 TTL 和 MINIMUM，没有 SOA 时不缓存
+func minTTL(resp *probe.Response) (uint32, bool) {
+	if (resp.Rcode != probe.RcodeSuccess && resp.Rcode != probe.RcodeNXDomain) || resp.Truncated {
+		return 0, false
+	}
+	var ttls []uint32
+	for _, rr := range resp.Answers {
+		ttls = append(ttls, rr.TTL)
+	}
+	if resp.Rcode == probe.RcodeNXDomain || len(resp.Answers) == 0 {
+		soaTTL, ok := negativeTTL(resp.Authority)
+		if !ok {
+			return 0, false
+		}
+		ttls = append(ttls, soaTTL)
+	}
+	ttl := ttls[0]
+	for _, t := range ttls[1:] {
+		if t < ttl {
+			ttl = t
+		}
+	}
+	return ttl, ttl > 0
+}
+
+// negativeTTL 返回授权段中 SOA 的 TTL 和 MINIMUM 中较小的值，不超过 dohMaxNegativeTTL
+func negativeTTL(authority []probe.RR) (uint32, bool) {
+	for _, rr := range authority {
+		// RDATA 最短为两个压缩指针加 5 个 32 位整数，MINIMUM 在最后
+		if rr.Type != probe.TypeSOA || len(rr.Data) < 2+2+20 {
+			continue
+		}
+		ttl := rr.TTL
+		if minimum := binary.BigEndian.Uint32(rr.Data[len(rr.Data)-4:]); minimum < ttl {
+			ttl = minimum
+		}
+		if ttl > dohMaxNegativeTTL {
+			ttl = dohMaxNegativeTTL
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// dnsCache 按 qname/qtype/qclass 以及 EDNS、DO、CD 缓存上游响应，最长缓存到最小 TTL 过期
+type dnsCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*cacheEntry
+	now     func() time.Time
+}
+
+type cacheEntry struct {
+	msg      []byte
+	storedAt time.Time
+	expires  time.Time
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{size: size, entries: make(map[string]*cacheEntry), now: time.Now}
+}
+
+func cacheKey(q probe.Question) string {
+	return fmt.Sprintf("%s/%d/%d/edns=%t/do=%t/cd=%t", strings.ToLower(q.Name), q.Type, q.Class, q.EDNS, q.DO, q.CD)
+}
+
+// get 返回以 id 为 ID、TTL 已扣除缓存时间的响应副本
+func (c *dnsCache) get(q probe.Question, id uint16) ([]byte, uint32, bool) {
+	if c.size == 0 {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[cacheKey(q)]
+	c.mu.Unlock()
+	now := c.now()
+	if !ok || !now.Before(entry.expires) {
+		return nil, 0, false
+	}
+	msg := append([]byte{}, entry.msg...)
+	if err := probe.AgeTTL(msg, uint32(now.Sub(entry.storedAt)/time.Second)); err != nil {
+		return nil, 0, false
+	}
+	binary.BigEndian.PutUint16(msg, id)
+	return msg, uint32(entry.expires.Sub(now) / time.Second), true
+}
+
+// put 缓存响应，缓存已满时先清理过期的条目，仍然满时随机淘汰一个
+func (c *dnsCache) put(q probe.Question, msg []byte, ttl uint32) {
+	if c.size == 0 {
+		return
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	if len(c.entries) >= c.size {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[cacheKey(q)] = &cacheEntry{
+		msg:      append([]byte{}, msg...),
+		storedAt: now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// rateLimiter 每个客户端 IP 一个令牌桶，容量为每秒速率的两倍
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (l *rateLimiter) allow(client string) bool {
+	if l.rate == 0 {
+		return true
+	}
+	burst := 2 * l.rate
+	if burst < 1 {
+		burst = 1
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buckets) >= dohMaxClients {
+		for key, b := range l.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= burst {
+				delete(l.buckets, key)
+			}
+		}
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * l.rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ns-check/internal/dnstest"
+	"ns-check/internal/probe"
+)
+
+// setupDoH 使用给定的上游和虚拟时钟创建 forwarder，测试结束后还原
+func setupDoH(t *testing.T, upstreams ...string) (*dohForwarder, *time.Time) {
+	t.Helper()
+	savedUpstreams, _ := dohUpstreams.Load().([]string)
+	savedTimeout := dohTimeout
+	t.Cleanup(func() {
+		dohUpstreams.Store(savedUpstreams)
+		dohTimeout = savedTimeout
+	})
+	dohUpstreams.Store(upstreams)
+	dohTimeout = 200 * time.Millisecond
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	f := &dohForwarder{cache: newDNSCache(16), limiter: newRateLimiter(0)}
+	f.cache.now, f.limiter.now = clock, clock
+	return f, &now
+}
+
+func answer(ttl uint32) dnstest.Handler {
+	return func(query []byte, tcp bool) []byte {
+		return dnstest.Reply(query, probe.RcodeSuccess, dnstest.A("192.0.2.1", ttl))
+	}
+}
+
+func rcode(code int) dnstest.Handler {
+	return func(query []byte, tcp bool) []byte {
+		return dnstest.Reply(query, code)
+	}
+}
+
+func buildQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	query, err := probe.BuildQuery(0, name, probe.TypeA, probe.ClassINET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func dohPost(f *dohForwarder, query []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(query))
+	req.Header.Set("Content-Type", dohContentType)
+	rec := httptest.NewRecorder()
+	f.handler(rec, req)
+	return rec
+}
+
+func dohResponse(t *testing.T, rec *httptest.ResponseRecorder) *probe.Response {
+	t.Helper()
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != dohContentType {
+		t.Fatalf("status %d, content type %q, body %q", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	resp, err := probe.ParseResponse(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestDoHFailover(t *testing.T) {
+	servfail := dnstest.NewServer(t, rcode(probe.RcodeServFail))
+	refused := dnstest.NewServer(t, rcode(probe.RcodeRefused))
+	timeout := dnstest.NewServer(t, func([]byte, bool) []byte { return nil })
+	good := dnstest.NewServer(t, answer(300))
+
+	// SERVFAIL、REFUSED 和超时都换下一个上游
+	f, _ := setupDoH(t, servfail.Addr, refused.Addr, timeout.Addr, good.Addr)
+	resp := dohResponse(t, dohPost(f, buildQuery(t, "example.com")))
+	if resp.Rcode != probe.RcodeSuccess || len(resp.Answers) != 1 {
+		t.Errorf("rcode %d with %d answers, want the answer of %s", resp.Rcode, len(resp.Answers), good.Addr)
+	}
+	for _, s := range []*dnstest.Server{servfail, refused, timeout, good} {
+		if s.UDPQueries() != 1 {
+			t.Errorf("%s got %d queries, want 1", s.Addr, s.UDPQueries())
+		}
+	}
+
+	// 都失败时返回最后收到的响应
+	f, _ = setupDoH(t, servfail.Addr, timeout.Addr, refused.Addr, timeout.Addr)
+	if resp := dohResponse(t, dohPost(f, buildQuery(t, "example.com"))); resp.Rcode != probe.RcodeRefused {
+		t.Errorf("rcode %d, want the last response REFUSED", resp.Rcode)
+	}
+
+	// 没有任何响应时返回 502
+	f, _ = setupDoH(t, timeout.Addr, dnstest.Unused(t))
+	if rec := dohPost(f, buildQuery(t, "example.com")); rec.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want 502", rec.Code)
+	}
+}
+
+func TestDoHRejectsMismatchedQuestion(t *testing.T) {
+	other := dnstest.NewServer(t, func(query []byte, tcp bool) []byte {
+		q, _ := probe.BuildQuery(0, "other.example.com", probe.TypeA, probe.ClassINET)
+		copy(q, query[:2])
+		return dnstest.Reply(q, probe.RcodeSuccess, dnstest.A("192.0.2.66", 300))
+	})
+	good := dnstest.NewServer(t, answer(300))
+	f, _ := setupDoH(t, other.Addr, good.Addr)
+	resp := dohResponse(t, dohPost(f, buildQuery(t, "example.com")))
+	if len(resp.Answers) != 1 || string(resp.Answers[0].Data) != string([]byte{192, 0, 2, 1}) {
+		t.Errorf("answers %v, want the answer of %s", resp.Answers, good.Addr)
+	}
+}
+
+func TestDoHCacheTTLAging(t *testing.T) {
+	upstream := dnstest.NewServer(t, answer(300))
+	f, now := setupDoH(t, upstream.Addr)
+	query := buildQuery(t, "example.com")
+
+	rec := dohPost(f, query)
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=300" {
+		t.Errorf("Cache-Control %q, want max-age=300", cc)
+	}
+
+	// 缓存命中时 TTL 扣除已缓存的时间，ID 使用本次查询的
+	*now = now.Add(100 * time.Second)
+	query[0], query[1] = 0x12, 0x34
+	rec = dohPost(f, query)
+	resp := dohResponse(t, rec)
+	if upstream.UDPQueries() != 1 {
+		t.Errorf("%d upstream queries, want a cache hit", upstream.UDPQueries())
+	}
+	if resp.ID != 0x1234 || resp.Answers[0].TTL != 200 {
+		t.Errorf("id %#x ttl %d, want 0x1234 and 200", resp.ID, resp.Answers[0].TTL)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=200" {
+		t.Errorf("Cache-Control %q, want max-age=200", cc)
+	}
+
+	// 过期后重新查询上游
+	*now = now.Add(200 * time.Second)
+	dohPost(f, query)
+	if upstream.UDPQueries() != 2 {
+		t.Errorf("%d upstream queries, want 2 after expiry", upstream.UDPQueries())
+	}
+
+	// 没有 SOA 的 NXDOMAIN 不缓存
+	nx := dnstest.NewServer(t, rcode(probe.RcodeNXDomain))
+	f, _ = setupDoH(t, nx.Addr)
+	dohPost(f, query)
+	dohPost(f, query)
+	if nx.UDPQueries() != 2 {
+		t.Errorf("%d upstream queries for NXDOMAIN without SOA, want 2", nx.UDPQueries())
+	}
+}
+
+// TestDoHNegativeCache NXDOMAIN 和 NODATA 按 SOA 的 TTL 和 MINIMUM 中较小的值缓存
+func TestDoHNegativeCache(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		rcode        int
+		ttl, minimum uint32
+		want         uint32
+	}{
+		{"nxdomain minimum", probe.RcodeNXDomain, 3600, 60, 60},
+		{"nxdomain soa ttl", probe.RcodeNXDomain, 30, 900, 30},
+		{"nodata", probe.RcodeSuccess, 3600, 120, 120},
+		{"capped", probe.RcodeNXDomain, 86400, 86400, dohMaxNegativeTTL},
+	} {
+		tc := tc
+		upstream := dnstest.NewServer(t, func(query []byte, tcp bool) []byte {
+			return dnstest.WithSOA(dnstest.Reply(query, tc.rcode), tc.ttl, tc.minimum)
+		})
+		f, now := setupDoH(t, upstream.Addr)
+		query := buildQuery(t, "missing.example.com")
+
+		rec := dohPost(f, query)
+		if cc, want := rec.Header().Get("Cache-Control"), fmt.Sprintf("max-age=%d", tc.want); cc != want {
+			t.Errorf("%s: Cache-Control %q, want %q", tc.name, cc, want)
+		}
+		*now = now.Add(time.Duration(tc.want-1) * time.Second)
+		if resp := dohResponse(t, dohPost(f, query)); resp.Rcode != tc.rcode || len(resp.Authority) != 1 {
+			t.Errorf("%s: rcode %d with %d authority records from the cache", tc.name, resp.Rcode, len(resp.Authority))
+		}
+		if upstream.UDPQueries() != 1 {
+			t.Errorf("%s: %d upstream queries, want a cache hit", tc.name, upstream.UDPQueries())
+		}
+		*now = now.Add(time.Second)
+		dohPost(f, query)
+		if upstream.UDPQueries() != 2 {
+			t.Errorf("%s: %d upstream queries, want 2 after expiry", tc.name, upstream.UDPQueries())
+		}
+	}
+}
+
+// withDO 设置 AddNSID 添加的 OPT 记录中的 DO 标志
+func withDO(query []byte) []byte {
+	query[len(query)-8] |= 0x80
+	return query
+}
+
+// withCD 设置头部的 CD 标志
+func withCD(query []byte) []byte {
+	query[3] |= 0x10
+	return query
+}
+
+func TestDoHCacheKeyEDNS(t *testing.T) {
+	upstream := dnstest.NewServer(t, func(query []byte, tcp bool) []byte {
+		resp := dnstest.Reply(query, probe.RcodeSuccess, dnstest.A("192.0.2.1", 300))
+		if dnstest.HasOPT(query) {
+			resp = dnstest.WithNSID(resp, "upstream")
+		}
+		return resp
+	})
+	f, _ := setupDoH(t, upstream.Addr)
+
+	// EDNS、DO 和 CD 不同的查询各自缓存
+	queries := [][]byte{
+		buildQuery(t, "example.com"),
+		probe.AddNSID(buildQuery(t, "example.com")),
+		withDO(probe.AddNSID(buildQuery(t, "example.com"))),
+		withCD(buildQuery(t, "example.com")),
+	}
+	for i, query := range queries {
+		resp := dohResponse(t, dohPost(f, query))
+		if got, want := probe.NSID(resp) != "", dnstest.HasOPT(query); got != want {
+			t.Errorf("query %d: OPT in response %v, want %v", i, got, want)
+		}
+		if upstream.UDPQueries() != i+1 {
+			t.Errorf("query %d answered from the cache entry of another query", i)
+		}
+	}
+	for i, query := range queries {
+		resp := dohResponse(t, dohPost(f, query))
+		if got, want := probe.NSID(resp) != "", dnstest.HasOPT(query); got != want {
+			t.Errorf("cached query %d: OPT in response %v, want %v", i, got, want)
+		}
+	}
+	if upstream.UDPQueries() != len(queries) {
+		t.Errorf("%d upstream queries, want %d", upstream.UDPQueries(), len(queries))
+	}
+}
+
+// TestDoHPreservesQuestionCase 响应的问题段与客户端查询一致，包括缓存命中时
+func TestDoHPreservesQuestionCase(t *testing.T) {
+	// 模拟把问题段改成小写的上游
+	upstream := dnstest.NewServer(t, func(query []byte, tcp bool) []byte {
+		resp := dnstest.Reply(query, probe.RcodeSuccess, dnstest.A("192.0.2.1", 300))
+		copy(resp[12:], strings.ToLower(string(query[12:len(query)-4])))
+		return resp
+	})
+	f, _ := setupDoH(t, upstream.Addr)
+
+	for _, name := range []string{"ExAmple.COM", "eXample.com"} {
+		query := buildQuery(t, name)
+		body := dohPost(f, query).Body.Bytes()
+		if len(body) < len(query) || !bytes.Equal(body[12:len(query)], query[12:]) {
+			t.Errorf("%s: question %q, want the client's %q", name, body[12:len(query)], query[12:])
+		}
+	}
+	if upstream.UDPQueries() != 1 {
+		t.Errorf("%d upstream queries, want names differing in case to share the cache", upstream.UDPQueries())
+	}
+}
+
+func TestDoHTruncatedRetriesTCP(t *testing.T) {
+	upstream := dnstest.NewServer(t, func(query []byte, tcp bool) []byte {
+		resp := dnstest.Reply(query, probe.RcodeSuccess, dnstest.A("192.0.2.1", 300), dnstest.A("192.0.2.2", 300))
+		if !tcp {
+			return dnstest.Truncated(resp)
+		}
+		return resp
+	})
+	f, _ := setupDoH(t, upstream.Addr)
+	resp := dohResponse(t, dohPost(f, buildQuery(t, "example.com")))
+	if resp.Truncated || len(resp.Answers) != 2 {
+		t.Errorf("truncated %v with %d answers, want the full TCP answer", resp.Truncated, len(resp.Answers))
+	}
+	if upstream.UDPQueries() != 1 || upstream.TCPQueries() != 1 {
+		t.Errorf("%d UDP and %d TCP queries, want 1 each", upstream.UDPQueries(), upstream.TCPQueries())
+	}
+}
+
+func TestDoHRequestErrors(t *testing.T) {
+	f, now := setupDoH(t, dnstest.Unused(t))
+	query := buildQuery(t, "example.com")
+	large := make([]byte, dohMaxMessageSize+1)
+
+	post := func(body []byte, contentType string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	get := func(msg []byte) *http.Request {
+		return httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(msg), nil)
+	}
+	for _, tc := range []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"POST too large", post(large, dohContentType), http.StatusRequestEntityTooLarge},
+		{"GET too large", get(large), http.StatusRequestEntityTooLarge},
+		{"wrong content type", post(query, "application/json"), http.StatusUnsupportedMediaType},
+		{"GET without dns", httptest.NewRequest(http.MethodGet, dohPath, nil), http.StatusBadRequest},
+		{"GET bad base64", httptest.NewRequest(http.MethodGet, dohPath+"?dns=!!", nil), http.StatusBadRequest},
+		{"not a query", get(dnstest.Reply(query, probe.RcodeSuccess)), http.StatusBadRequest},
+		{"PUT", httptest.NewRequest(http.MethodPut, dohPath, nil), http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		f.handler(rec, tc.req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.code)
+		}
+	}
+
+	// 每秒 1 个、容量 2 的令牌桶，按客户端 IP 分别计算
+	f.limiter = newRateLimiter(1)
+	f.limiter.now = func() time.Time { return *now }
+	request := func(remote string) int {
+		req := httptest.NewRequest(http.MethodGet, dohPath, nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		f.handler(rec, req)
+		return rec.Code
+	}
+	for i, want := range []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusTooManyRequests} {
+		if code := request("192.0.2.10:1234"); code != want {
+			t.Errorf("request %d: status %d, want %d", i, code, want)
+		}
+	}
+	if code := request("192.0.2.11:1234"); code == http.StatusTooManyRequests {
+		t.Error("another client was rate limited")
+	}
+	*now = now.Add(time.Second)
+	if code := request("192.0.2.10:5678"); code == http.StatusTooManyRequests {
+		t.Error("still rate limited after a token was refilled")
+	}
+}
+
+func TestDoHTrustedProxy(t *testing.T) {
+	f, now := setupDoH(t, dnstest.Unused(t))
+	var err error
+	if f.trustedProxies, err = parseTrustedProxies("10.0.0.1, 192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	f.limiter = newRateLimiter(1)
+	f.limiter.now = func() time.Time { return *now }
+
+	for _, tc := range []struct {
+		remote, xff, want string
+	}{
+		// 不是可信代理时忽略 X-Forwarded-For
+		{"198.51.100.1:1234", "203.0.113.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "203.0.113.1", "203.0.113.1"},
+		// 跳过可信的代理链，客户端伪造的左侧地址不使用
+		{"10.0.0.1:1234", "198.51.100.7, 203.0.113.1, 192.0.2.5", "203.0.113.1"},
+		{"10.0.0.1:1234", "192.0.2.9, 192.0.2.5", "192.0.2.9"},
+		{"10.0.0.1:1234", "garbage, 192.0.2.5", "192.0.2.5"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, dohPath, nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := f.clientIP(req); got != tc.want {
+			t.Errorf("%s with %q: client %s, want %s", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+
+	// 同一个代理后的不同客户端分别限速
+	request := func(xff string) int {
+		req := httptest.NewRequest(http.MethodGet, dohPath, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", xff)
+		rec := httptest.NewRecorder()
+		f.handler(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < 2; i++ {
+		request("203.0.113.1")
+	}
+	if code := request("203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Errorf("third request of a client: status %d, want 429", code)
+	}
+	if code := request("203.0.113.2"); code == http.StatusTooManyRequests {
+		t.Error("another client behind the same proxy was limited")
+	}
+
+	for _, bad := range []string{"10.0.0", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
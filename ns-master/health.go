@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ns-check/internal/netutil"
+	"ns-check/internal/probe"
+)
+
+const healthPath = "/api/health"
+
+// healthChecker 定期按各租户的探测方式检查 nameserver，
+// 结果用于过滤不健康的 nameserver 和按分数排序
+type healthChecker struct {
+	mu        sync.RWMutex
+	results   map[string]probe.Result
+	checkedAt time.Time
+}
+
+// healthStatus /api/health 中单个 nameserver 的结果
+type healthStatus struct {
+	Tenant     string `json:"tenant,omitempty"`
+	Nameserver string `json:"nameserver"`
+	Healthy    bool   `json:"healthy"`
+	probe.Result
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{results: make(map[string]probe.Result)}
+}
+
+func healthKey(mode probe.Mode, nameserver string) string {
+	return string(mode) + "/" + nameserver
+}
+
+// validateHealthFlags 校验健康检查参数和各租户的探测方式
+func validateHealthFlags(modes tenantTokens) error {
+	if healthInterval < 0 || healthTimeout <= 0 || healthSamples < 1 {
+		return fmt.Errorf("-health-interval must not be negative, -health-timeout and -health-samples must be positive")
+	}
+	if _, err := probe.ParseMode(healthMode); err != nil {
+		return fmt.Errorf("-health-mode: %v", err)
+	}
+	for name, mode := range modes {
+		if _, err := probe.ParseMode(mode); err != nil {
+			return fmt.Errorf("-tenant-health-mode %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// run 每个 -health-interval 检查一轮，检查完成后重新渲染所有响应
+func (h *healthChecker) run(ctx context.Context) {
+	for {
+		h.checkAll(ctx)
+		if err := renderAll(); err != nil {
+			log.Println("Failed to render responses after health check:", err)
+		}
+		if !netutil.Sleep(ctx, healthInterval) {
+			return
+		}
+	}
+}
+
+func (h *healthChecker) checkAll(ctx context.Context) {
+	targets := make(map[string]probe.Mode)
+	for _, t := range allTenants {
+		for _, ns := range normalizeNameservers(strings.Split(t.nameservers, ",")) {
+			targets[healthKey(t.healthMode, ns)] = t.healthMode
+		}
+	}
+
+	results := make(map[string]probe.Result, len(targets))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for key, mode := range targets {
+		wg.Add(1)
+		go func(key string, mode probe.Mode) {
+			defer wg.Done()
+			nameserver := strings.TrimPrefix(key, string(mode)+"/")
+			result := probe.Measure(ctx, mode, nameserver, healthTimeout, healthSamples)
+			if !result.Healthy() {
+				log.Printf("Nameserver %s unhealthy, %d/%d %s probes succeeded: %s", nameserver, result.Successes, result.Samples, mode, result.Err)
+			}
+			mu.Lock()
+			results[key] = result
+			mu.Unlock()
+		}(key, mode)
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	h.results = results
+	h.checkedAt = time.Now()
+	h.mu.Unlock()
+}
+
+// filter 去掉不健康的 nameserver 并按分数排序，没有结果的 nameserver 保留在末尾；
+// 全部不健康时返回原列表，避免返回空列表
+func (h *healthChecker) filter(t *tenant, list []string, trace *decisionTrace) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.checkedAt.IsZero() {
+		trace.add("health", "no health check finished yet, nothing filtered", list)
+		return list
+	}
+
+	healthy := make([]string, 0, len(list))
+	var unknown, removed []string
+	for _, ns := range list {
+		result, ok := h.results[healthKey(t.healthMode, ns)]
+		switch {
+		case !ok:
+			unknown = append(unknown, ns)
+		case result.Healthy():
+			healthy = append(healthy, ns)
+		default:
+			removed = append(removed, ns)
+		}
+	}
+	if len(healthy) == 0 && len(unknown) == 0 {
+		trace.add("health", fmt.Sprintf("all nameservers unhealthy by %s, nothing filtered", t.healthMode), list)
+		return list
+	}
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return h.results[healthKey(t.healthMode, healthy[i])].Score < h.results[healthKey(t.healthMode, healthy[j])].Score
+	})
+	result := append(healthy, unknown...)
+	trace.add("health", fmt.Sprintf("removed unhealthy %v by %s, ranked by score", removed, t.healthMode), result)
+	return result
+}
+
+// handler 返回默认租户 nameserver 的最近一次检查结果，
+// 其他租户只有请求带有该租户自己的调试 token 时才返回
+func (h *healthChecker) handler(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	var statuses []healthStatus
+	for _, t := range allTenants {
+		if t.name != "" && !debugAuthorized(r, t) {
+			continue
+		}
+		for _, ns := range normalizeNameservers(strings.Split(t.nameservers, ",")) {
+			result, ok := h.results[healthKey(t.healthMode, ns)]
+			if !ok {
+				result = probe.Result{Mode: t.healthMode}
+			}
+			statuses = append(statuses, healthStatus{Tenant: t.name, Nameserver: ns, Healthy: result.Healthy(), Result: result})
+		}
+	}
+	checkedAt := h.checkedAt
+	h.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(struct {
+		CheckedAt   time.Time      `json:"checkedAt"`
+		Nameservers []healthStatus `json:"nameservers"`
+	}{checkedAt, statuses})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
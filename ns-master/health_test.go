@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"ns-check/internal/dnstest"
+	"ns-check/internal/probe"
+)
+
+// healthServers 假 nameserver 的地址
+type healthServers struct {
+	ok, servfail, silent, down, slow, dot string
+}
+
+// list 按 slow、ok、servfail、silent、down 的顺序返回逗号分隔的列表
+func (s healthServers) list() string {
+	return strings.Join([]string{s.slow, s.ok, s.servfail, s.silent, s.down}, ",")
+}
+
+// setupHealthServers 启动假 nameserver：ok 正常应答，servfail 返回 SERVFAIL，silent 不应答，
+// down 没有服务，slow 延迟 50ms 后正常应答，dot 只提供 DoT
+func setupHealthServers(t *testing.T) healthServers {
+	t.Helper()
+	reply := func(rcode int, delay time.Duration) dnstest.Handler {
+		return func(query []byte, tcp bool) []byte {
+			time.Sleep(delay)
+			return dnstest.Reply(query, rcode)
+		}
+	}
+	s := healthServers{
+		ok:       dnstest.NewServer(t, reply(probe.RcodeSuccess, 0)).Addr,
+		servfail: dnstest.NewServer(t, reply(probe.RcodeServFail, 0)).Addr,
+		silent:   dnstest.NewServer(t, func([]byte, bool) []byte { return nil }).Addr,
+		down:     dnstest.Unused(t),
+		slow:     dnstest.NewServer(t, reply(probe.RcodeSuccess, 50*time.Millisecond)).Addr,
+	}
+
+	saved := probe.DoTRootCAs
+	s.dot, probe.DoTRootCAs = dnstest.NewDoTServer(t)
+	savedTimeout, savedSamples := healthTimeout, healthSamples
+	t.Cleanup(func() {
+		probe.DoTRootCAs = saved
+		healthTimeout, healthSamples = savedTimeout, savedSamples
+	})
+	healthTimeout, healthSamples = 300*time.Millisecond, 1
+	return s
+}
+
+func TestHealthCheckModes(t *testing.T) {
+	s := setupHealthServers(t)
+	nameservers := s.list() + "," + s.dot
+	setupTestServer(t, nameservers,
+		&tenant{name: "udp", nameservers: nameservers, healthMode: probe.ModeUDPQuery},
+		&tenant{name: "dot", nameservers: nameservers, healthMode: probe.ModeDoTHandshake},
+	)
+	allTenants[0].healthMode = probe.ModeTCPConnect
+	health = newHealthChecker()
+	health.checkAll(context.Background())
+
+	for _, tc := range []struct {
+		mode    probe.Mode
+		healthy map[string]bool
+	}{
+		// TCP 连接不关心应答内容，只有没有服务的失败
+		{probe.ModeTCPConnect, map[string]bool{s.ok: true, s.servfail: true, s.silent: true, s.down: false, s.slow: true, s.dot: true}},
+		// SERVFAIL、不应答和没有服务都不健康
+		{probe.ModeUDPQuery, map[string]bool{s.ok: true, s.servfail: false, s.silent: false, s.down: false, s.slow: true, s.dot: false}},
+		// 只有 dot 提供 DoT
+		{probe.ModeDoTHandshake, map[string]bool{s.ok: false, s.servfail: false, s.silent: false, s.down: false, s.slow: false, s.dot: true}},
+	} {
+		for ns, want := range tc.healthy {
+			result, ok := health.results[healthKey(tc.mode, ns)]
+			if !ok {
+				t.Errorf("%s %s: not checked", tc.mode, ns)
+				continue
+			}
+			if result.Healthy() != want || result.Mode != tc.mode {
+				t.Errorf("%s %s: %+v, want healthy %v", tc.mode, ns, result, want)
+			}
+		}
+	}
+}
+
+func TestHealthFilterAndRank(t *testing.T) {
+	s := setupHealthServers(t)
+	setupTestServer(t, s.list(),
+		&tenant{name: "udp", nameservers: s.list(), healthMode: probe.ModeUDPQuery},
+		&tenant{name: "dot", nameservers: s.ok + "," + s.dot, healthMode: probe.ModeDoTHandshake},
+	)
+	allTenants[0].healthMode = probe.ModeTCPConnect
+
+	// 还没有检查结果时不过滤
+	health = newHealthChecker()
+	if got := buildResponse(allTenants[1], nil).Nameservers; !reflect.DeepEqual(got, strings.Split(s.list(), ",")) {
+		t.Errorf("before the first check: %v, want unfiltered", got)
+	}
+
+	health.checkAll(context.Background())
+	for _, tc := range []struct {
+		tenant *tenant
+		want   []string
+	}{
+		// 延迟高的 slow 排在后面
+		{allTenants[1], []string{s.ok, s.slow}},
+		{allTenants[2], []string{s.dot}},
+	} {
+		if got := buildResponse(tc.tenant, nil).Nameservers; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.tenant, got, tc.want)
+		}
+	}
+	if got := buildResponse(allTenants[0], nil).Nameservers; len(got) != 4 || containsString(got, s.down) {
+		t.Errorf("default tenant: %v, want all but %s", got, s.down)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHealthHandlerTenantAccess(t *testing.T) {
+	setupTestServer(t, "1.1.1.1",
+		&tenant{name: "teamA", nameservers: "10.0.0.1", healthMode: probe.ModeTCPConnect},
+		&tenant{name: "teamB", nameservers: "10.0.0.2", healthMode: probe.ModeTCPConnect},
+	)
+	allTenants[0].healthMode = probe.ModeTCPConnect
+	allTenants[1].debugTokenValue.Store("token-a")
+	allTenants[2].debugTokenValue.Store("token-b")
+	health = newTestHealthChecker(probe.ModeTCPConnect, map[string]time.Duration{
+		"1.1.1.1": time.Millisecond, "10.0.0.1": time.Millisecond, "10.0.0.2": 0,
+	})
+
+	for _, tc := range []struct {
+		token string
+		want  []string
+	}{
+		// 没有 token 时只返回默认租户
+		{"", []string{"/1.1.1.1"}},
+		{"wrong", []string{"/1.1.1.1"}},
+		{"token-a", []string{"/1.1.1.1", "teamA/10.0.0.1"}},
+		{"token-b", []string{"/1.1.1.1", "teamB/10.0.0.2"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, healthPath, nil)
+		if tc.token != "" {
+			req.Header.Set(debugHeader, tc.token)
+		}
+		rec := httptest.NewRecorder()
+		health.handler(rec, req)
+
+		var body struct {
+			Nameservers []healthStatus `json:"nameservers"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode %q: %v", rec.Body.String(), err)
+		}
+		var got []string
+		for _, status := range body.Nameservers {
+			got = append(got, status.Tenant+"/"+status.Nameserver)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("token %q: %v, want %v", tc.token, got, tc.want)
+		}
+	}
+}
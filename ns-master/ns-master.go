@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"strings"
+	"time"
+
+	"ns-check/internal/probe"
 )
 
 type NameserversResponse struct {
-	Nameservers []string `json:"nameservers"`
-	EndpointURL string   `json:"endpointURL"`
+	Nameservers   []string     `json:"nameservers"`
+	EndpointURL   string       `json:"endpointURL"`
+	PoolSize      int          `json:"poolSize"`
+	DecisionTrace []traceEntry `json:"decisionTrace,omitempty"`
 }
 
 var (
@@ -19,33 +29,296 @@ var (
 	endpoint    string
 	endpointURL string
 	nameservers string
+	maxServed   int
+	debug       bool
+	debugToken  string
+	compats     compatEndpoints
+	tenants     tenantList
+	tokens      = tenantTokens{}
+	healthModes = tenantTokens{}
+	// maxServedCounts -tenant-max-served 按租户覆盖 -max-served
+	maxServedCounts = tenantTokens{}
+
+	healthInterval time.Duration
+	healthMode     string
+	healthTimeout  time.Duration
+	healthSamples  int
+	health         *healthChecker
+
+	dohListen         string
+	dohCert           string
+	dohKey            string
+	dohTimeout        time.Duration
+	dohRate           float64
+	dohCacheSize      int
+	dohTrustedProxies string
+
+	// allTenants 第一个为默认租户
+	allTenants []*tenant
 )
 
+// renderedResponse 缓存序列化后的响应和对应的 ETag，避免每次请求重复编码
+type renderedResponse struct {
+	body        []byte
+	etag        string
+	contentType string
+}
+
 func init() {
 	flag.IntVar(&port, "port", 5353, "Port number for the server")
 	flag.StringVar(&endpoint, "endpoint", "/nameservers", "Endpoint URL for fetching nameservers")
 	flag.StringVar(&endpointURL, "endpoint-url", "http://127.0.0.1:5353/nameservers", "Endpoint url will used by client")
 	flag.StringVar(&nameservers, "nameservers", "8.8.8.8,8.8.4.4,1.1.1.1", "Comma-separated list of nameservers")
-	flag.Parse()
+	flag.IntVar(&maxServed, "max-served", 0, "Maximum number of nameservers in a response, 0 means all")
+	flag.Var(maxServedCounts, "tenant-max-served", "Maximum number of nameservers in a response of a tenant as name=N, overrides -max-served, can be repeated")
+	flag.Var(&compats, "compat-endpoint", "Extra endpoint for legacy clients as /path=template[,ttl], template is bare-array, v1 or plaintext, can be repeated")
+	flag.Var(&tenants, "tenant", "Extra tenant served under /t/{tenant} as name=ns1,ns2, can be repeated")
+	flag.Var(tokens, "tenant-debug-token", "Debug token of a tenant as name=token, token may be a secret reference, can be repeated")
+	flag.DurationVar(&healthInterval, "health-interval", 0, "Interval between health checks of the nameservers, 0 disables health checks")
+	flag.StringVar(&healthMode, "health-mode", string(probe.ModeTCPConnect), "Health check mode, tcp-connect, udp-query or dot-handshake")
+	flag.DurationVar(&healthTimeout, "health-timeout", 2*time.Second, "Timeout for a single health check probe")
+	flag.IntVar(&healthSamples, "health-samples", 1, "Number of probes per nameserver each round, healthy when at least half succeed")
+	flag.Var(healthModes, "tenant-health-mode", "Health check mode of a tenant as name=mode, can be repeated")
+	flag.StringVar(&dohListen, "doh-listen", "", "Listen address of the DNS-over-HTTPS forwarder serving "+dohPath+", empty disables it")
+	flag.StringVar(&dohCert, "doh-cert", "", "TLS certificate file of the DNS-over-HTTPS forwarder, plain HTTP when empty")
+	flag.StringVar(&dohKey, "doh-key", "", "TLS key file of the DNS-over-HTTPS forwarder")
+	flag.DurationVar(&dohTimeout, "doh-timeout", 2*time.Second, "Timeout of a forwarded query to a single nameserver")
+	flag.Float64Var(&dohRate, "doh-rate", 50, "DNS-over-HTTPS queries per second allowed per client IP, 0 means unlimited")
+	flag.IntVar(&dohCacheSize, "doh-cache-size", 1024, "Maximum number of cached DNS-over-HTTPS responses, 0 disables the cache")
+	flag.StringVar(&dohTrustedProxies, "doh-trusted-proxies", "", "Comma-separated IPs or CIDRs of reverse proxies whose X-Forwarded-For is used as the client IP for -doh-rate")
+	flag.BoolVar(&debug, "debug", false, "Log decision trace of every request, responses only carry it with a valid debug token")
+	flag.StringVar(&debugToken, "debug-token", "", "Token authorizing per-request decision trace via X-NS-Debug header, may be env:NAME, file:/path or exec:command")
 }
 
 func main() {
-	http.HandleFunc(endpoint, nameserversHandler)
+	flag.Parse()
+	if maxServed < 0 {
+		log.Fatalf("Invalid -max-served %d, must not be negative", maxServed)
+	}
+	if err := validateCompatEndpoints(compats); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateHealthFlags(healthModes); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateDoHFlags(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupTenants(tenants, tokens, healthModes, maxServedCounts); err != nil {
+		log.Fatal(err)
+	}
+	allTenants = append([]*tenant{newDefaultTenant()}, tenants...)
+	if err := loadSecrets(); err != nil {
+		log.Fatal(err)
+	}
+	// 升级后排空期间仍然处理 SIGHUP，退出时才停止
+	stopReload := reloadSecretsOnHUP()
+	defer stopReload()
+
+	if err := renderAll(); err != nil {
+		log.Fatal(err)
+	}
+	if healthInterval > 0 {
+		health = newHealthChecker()
+	}
+	registerHandlers(http.DefaultServeMux)
+	if health != nil {
+		go health.run(context.Background())
+	}
+
 	addr := fmt.Sprintf(":%d", port)
-	log.Printf("Server listening on %s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	ln, err := listen(addr, envListenFD)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tracker := newConnTracker()
+	server := &http.Server{ConnState: tracker.connState}
+	servers, lns := []*http.Server{server}, []net.Listener{ln}
+	if dohListen != "" {
+		dohLn, err := listen(dohListen, envDoHFD)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dohServer := &http.Server{ConnState: tracker.connState}
+		servers, lns = append(servers, dohServer), append(lns, dohLn)
+		go func() {
+			log.Printf("DNS-over-HTTPS forwarder listening on %s%s", dohLn.Addr(), dohPath)
+			if err := newDoHForwarder().serve(dohServer, dohLn); err != http.ErrServerClosed && !upgrading.Load() {
+				log.Fatal(err)
+			}
+		}()
+	}
+	drained := make(chan struct{})
+	go handleUpgrade(servers, lns, tracker, drained)
+	notifyReady()
+
+	log.Printf("Server listening on %s (pid %d)\n", ln.Addr(), os.Getpid())
+	if err := server.Serve(ln); err != http.ErrServerClosed && !upgrading.Load() {
+		log.Fatal(err)
+	}
+	<-drained
+	log.Println("Server drained, exiting")
 }
 
-func nameserversHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s send a request", r.RemoteAddr)
-	var response NameserversResponse
-	response.Nameservers = strings.Split(nameservers, ",")
-	response.EndpointURL = endpointURL
+// registerHandlers 注册所有租户、兼容接口和健康检查结果的路由
+func registerHandlers(mux *http.ServeMux) {
+	for _, t := range allTenants {
+		mux.HandleFunc(t.path, t.handler)
+		log.Printf("Endpoint %s serving %s", t.path, t)
+	}
+	for _, e := range compats {
+		mux.HandleFunc(e.path, e.handler)
+		log.Printf("Compat endpoint %s serving %s", e.path, e.template)
+	}
+	if health != nil {
+		mux.HandleFunc(healthPath, health.handler)
+	}
+}
+
+func (t *tenant) handler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s send a request to %s", r.RemoteAddr, t)
+	if debugAuthorized(r, t) {
+		t.serveDebug(w, r)
+		return
+	}
+	if debug {
+		t.logTrace(r)
+	}
+	serveRendered(w, r, t.rendered.Load().(*renderedResponse))
+}
+
+// renderAll 重新渲染所有租户和兼容接口的响应，选择结果变化后调用
+func renderAll() error {
+	for _, t := range allTenants {
+		rendered, err := renderJSON(buildResponse(t, nil))
+		if err != nil {
+			return err
+		}
+		t.rendered.Store(rendered)
+	}
+	response := buildResponse(allTenants[0], nil)
+	dohUpstreams.Store(response.Nameservers)
+	for _, e := range compats {
+		rendered, err := renderCompat(e, response)
+		if err != nil {
+			return err
+		}
+		e.rendered.Store(rendered)
+	}
+	return nil
+}
+
+// serveDebug 重新执行选择流程并附带决策过程，不使用缓存
+func (t *tenant) serveDebug(w http.ResponseWriter, r *http.Request) {
+	response := t.logTrace(r)
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 }
+
+// logTrace 重新执行选择流程并把决策过程写入日志，返回带决策过程的响应
+func (t *tenant) logTrace(r *http.Request) NameserversResponse {
+	trace := &decisionTrace{}
+	response := buildResponse(t, trace)
+	response.DecisionTrace = trace.entries
+	traceJSON, _ := json.Marshal(trace.entries)
+	log.Printf("%s decision trace %s", r.RemoteAddr, traceJSON)
+	return response
+}
+
+func buildResponse(t *tenant, trace *decisionTrace) NameserversResponse {
+	var response NameserversResponse
+	pool := selectNameservers(t, trace)
+	response.Nameservers = shapeNameservers(pool, t.maxServed, trace)
+	response.PoolSize = len(pool)
+	response.EndpointURL = t.endpointURL
+	return response
+}
+
+// shapeNameservers 按租户的 -max-served 截取排在最前面的 nameserver
+func shapeNameservers(pool []string, max int, trace *decisionTrace) []string {
+	if max == 0 || len(pool) <= max {
+		return pool
+	}
+	shaped := pool[:max]
+	trace.add("max-served", fmt.Sprintf("kept first %d of %d nameservers", max, len(pool)), shaped)
+	return shaped
+}
+
+// selectNameservers 依次执行各选择阶段，trace 不为 nil 时记录每个阶段的决策
+func selectNameservers(t *tenant, trace *decisionTrace) []string {
+	list := strings.Split(t.nameservers, ",")
+	if t.name == "" {
+		trace.add("source", "-nameservers flag", list)
+	} else {
+		trace.add("source", "-tenant "+t.name, list)
+	}
+
+	list = normalizeNameservers(list)
+	trace.add("normalize", "trimmed spaces, dropped empty and duplicate entries", list)
+
+	if health != nil {
+		list = health.filter(t, list, trace)
+	}
+
+	return list
+}
+
+func normalizeNameservers(list []string) []string {
+	seen := make(map[string]bool, len(list))
+	result := make([]string, 0, len(list))
+	for _, ns := range list {
+		ns = strings.TrimSpace(ns)
+		if ns == "" || seen[ns] {
+			continue
+		}
+		seen[ns] = true
+		result = append(result, ns)
+	}
+	return result
+}
+
+func renderJSON(v interface{}) (*renderedResponse, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body, '\n')
+	return newRenderedResponse(body, "application/json"), nil
+}
+
+func newRenderedResponse(body []byte, contentType string) *renderedResponse {
+	sum := sha256.Sum256(body)
+	return &renderedResponse{
+		body:        body,
+		etag:        `"` + hex.EncodeToString(sum[:8]) + `"`,
+		contentType: contentType,
+	}
+}
+
+// serveRendered 直接写出缓存的响应，客户端 ETag 未变化时返回 304
+func serveRendered(w http.ResponseWriter, r *http.Request, rendered *renderedResponse) {
+	w.Header().Set("ETag", rendered.etag)
+	if etagMatch(r.Header.Get("If-None-Match"), rendered.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", rendered.contentType)
+	w.Write(rendered.body)
+}
+
+// etagMatch 按 If-None-Match 的弱比较规则判断，支持 *、W/ 前缀和逗号分隔的多个 ETag
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"ns-check/internal/probe"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// setupTestServer 使用给定的默认 nameserver 列表和额外租户初始化全局状态并渲染响应，
+// 测试结束后还原
+func setupTestServer(t testing.TB, defaultNameservers string, extra ...*tenant) {
+	t.Helper()
+	saved := struct {
+		nameservers, endpoint, endpointURL, debugToken string
+		maxServed                                      int
+		debug                                          bool
+		health                                         *healthChecker
+		allTenants                                     []*tenant
+		compats                                        compatEndpoints
+	}{nameservers, endpoint, endpointURL, debugToken, maxServed, debug, health, allTenants, compats}
+	t.Cleanup(func() {
+		nameservers, endpoint, endpointURL, debugToken = saved.nameservers, saved.endpoint, saved.endpointURL, saved.debugToken
+		maxServed, debug, health, allTenants, compats = saved.maxServed, saved.debug, saved.health, saved.allTenants, saved.compats
+	})
+
+	nameservers = defaultNameservers
+	endpoint = "/nameservers"
+	endpointURL = "http://127.0.0.1:5353/nameservers"
+	allTenants = append([]*tenant{newDefaultTenant()}, extra...)
+	if err := renderAll(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func decodeResponse(t testing.TB, rec *httptest.ResponseRecorder) NameserversResponse {
+	t.Helper()
+	var response NameserversResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	return response
+}
+
+func TestServeRenderedNotModified(t *testing.T) {
+	setupTestServer(t, "1.1.1.1,8.8.8.8")
+	handler := allTenants[0].handler
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/nameservers", nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first request: status %d, etag %q", rec.Code, etag)
+	}
+
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, "*", `"other", ` + etag} {
+		req := httptest.NewRequest(http.MethodGet, "/nameservers", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: status %d, body %q, want 304 without body", ifNoneMatch, rec.Code, rec.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/nameservers", nil)
+	req.Header.Set("If-None-Match", `"other", W/"stale"`)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Errorf("stale ETag: status %d, want 200 with body", rec.Code)
+	}
+}
+
+func TestRenderedETagFollowsSelection(t *testing.T) {
+	setupTestServer(t, "1.1.1.1,8.8.8.8")
+	before := allTenants[0].rendered.Load().(*renderedResponse).etag
+
+	if err := renderAll(); err != nil {
+		t.Fatal(err)
+	}
+	if after := allTenants[0].rendered.Load().(*renderedResponse).etag; after != before {
+		t.Errorf("ETag changed from %s to %s without a selection change", before, after)
+	}
+
+	allTenants[0].maxServed = 1
+	if err := renderAll(); err != nil {
+		t.Fatal(err)
+	}
+	if after := allTenants[0].rendered.Load().(*renderedResponse).etag; after == before {
+		t.Error("ETag unchanged after the selection changed")
+	}
+}
+
+func TestShapeNameservers(t *testing.T) {
+	setupTestServer(t, "1.1.1.1,8.8.8.8,9.9.9.9")
+	for _, tc := range []struct {
+		maxServed int
+		want      []string
+	}{
+		{0, []string{"1.1.1.1", "8.8.8.8", "9.9.9.9"}},
+		{1, []string{"1.1.1.1"}},
+		{2, []string{"1.1.1.1", "8.8.8.8"}},
+		{3, []string{"1.1.1.1", "8.8.8.8", "9.9.9.9"}},
+		{5, []string{"1.1.1.1", "8.8.8.8", "9.9.9.9"}},
+	} {
+		allTenants[0].maxServed = tc.maxServed
+		if err := renderAll(); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		allTenants[0].handler(rec, httptest.NewRequest(http.MethodGet, "/nameservers", nil))
+		response := decodeResponse(t, rec)
+		if !reflect.DeepEqual(response.Nameservers, tc.want) {
+			t.Errorf("max-served %d: nameservers %v, want %v", tc.maxServed, response.Nameservers, tc.want)
+		}
+		if response.PoolSize != 3 {
+			t.Errorf("max-served %d: poolSize %d, want 3", tc.maxServed, response.PoolSize)
+		}
+	}
+}
+
+// newTestHealthChecker 返回已完成一轮检查的 healthChecker，scores 为 0 表示不健康
+func newTestHealthChecker(mode probe.Mode, scores map[string]time.Duration) *healthChecker {
+	h := newHealthChecker()
+	for ns, score := range scores {
+		result := probe.Result{Mode: mode, Samples: 1, Latency: score, Score: score}
+		if score > 0 {
+			result.Successes = 1
+		}
+		h.results[healthKey(mode, ns)] = result
+	}
+	h.checkedAt = time.Now()
+	return h
+}
+
+func TestShapeAfterHealthFilter(t *testing.T) {
+	setupTestServer(t, "1.1.1.1,8.8.8.8,9.9.9.9,4.4.4.4")
+	health = newTestHealthChecker(probe.ModeTCPConnect, map[string]time.Duration{
+		"1.1.1.1": 0,
+		"8.8.8.8": 30 * time.Millisecond,
+		"9.9.9.9": 10 * time.Millisecond,
+	})
+	allTenants[0].healthMode = probe.ModeTCPConnect
+	allTenants[0].maxServed = 2
+	if err := renderAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 健康检查先去掉不健康的并按分数排序，截取的是排名最前的
+	response := buildResponse(allTenants[0], nil)
+	if want := []string{"9.9.9.9", "8.8.8.8"}; !reflect.DeepEqual(response.Nameservers, want) {
+		t.Errorf("nameservers %v, want %v", response.Nameservers, want)
+	}
+	// poolSize 为健康过滤之后、截取之前的数量，没有结果的 nameserver 保留
+	if response.PoolSize != 3 {
+		t.Errorf("poolSize %d, want 3", response.PoolSize)
+	}
+
+	// 全部不健康时不过滤，仍然按 -max-served 截取
+	health = newTestHealthChecker(probe.ModeTCPConnect, map[string]time.Duration{
+		"1.1.1.1": 0, "8.8.8.8": 0, "9.9.9.9": 0, "4.4.4.4": 0,
+	})
+	response = buildResponse(allTenants[0], nil)
+	if want := []string{"1.1.1.1", "8.8.8.8"}; !reflect.DeepEqual(response.Nameservers, want) || response.PoolSize != 4 {
+		t.Errorf("all unhealthy: nameservers %v, poolSize %d, want %v and 4", response.Nameservers, response.PoolSize, want)
+	}
+}
+
+func BenchmarkServeRendered(b *testing.B) {
+	setupTestServer(b, "1.1.1.1,8.8.8.8,8.8.4.4,9.9.9.9")
+	req := httptest.NewRequest(http.MethodGet, "/nameservers", nil)
+	rendered := allTenants[0].rendered.Load().(*renderedResponse)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		serveRendered(httptest.NewRecorder(), req, rendered)
+	}
+}
+
+// BenchmarkEncodePerRequest 每次请求重新选择和编码，预渲染之前的做法
+func BenchmarkEncodePerRequest(b *testing.B) {
+	setupTestServer(b, "1.1.1.1,8.8.8.8,8.8.4.4,9.9.9.9")
+	t := allTenants[0]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(buildResponse(t, nil)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkServeRenderedNotModified(b *testing.B) {
+	setupTestServer(b, "1.1.1.1,8.8.8.8,8.8.4.4,9.9.9.9")
+	rendered := allTenants[0].rendered.Load().(*renderedResponse)
+	req := httptest.NewRequest(http.MethodGet, "/nameservers", nil)
+	req.Header.Set("If-None-Match", rendered.etag)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		serveRendered(httptest.NewRecorder(), req, rendered)
+	}
+}
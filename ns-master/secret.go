@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// secretExecTimeout exec: 引用命令的最长执行时间，避免卡住启动或之后的每次重新加载
+var secretExecTimeout = 10 * time.Second
+
+// secretExecWaitDelay 命令被结束后等待输出关闭的最长时间，
+// 子进程留下的后台进程仍然持有 stdout 时不会一直阻塞
+const secretExecWaitDelay = time.Second
+
+// resolveSecret 解析密钥引用：env:NAME、file:/path、exec:command args，其他值视为字面量。
+// 返回的错误不包含密钥内容
+func resolveSecret(ref string) (string, error) {
+	kind, value, ok := strings.Cut(ref, ":")
+	if !ok {
+		return ref, nil
+	}
+	switch kind {
+	case "env":
+		secret, ok := os.LookupEnv(value)
+		if !ok || secret == "" {
+			return "", fmt.Errorf("environment variable %s is not set", value)
+		}
+		return secret, nil
+	case "file":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "exec":
+		args := strings.Fields(value)
+		if len(args) == 0 {
+			return "", fmt.Errorf("empty exec secret reference")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.WaitDelay = secretExecWaitDelay
+		out, err := cmd.Output()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("exec %s: timed out after %s", args[0], secretExecTimeout)
+		}
+		if err != nil {
+			// 错误会写入日志，只返回退出状态，不带可能包含密钥的 stderr
+			return "", fmt.Errorf("exec %s: %v", args[0], err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	return ref, nil
+}
+
+// loadSecrets 解析所有租户的密钥引用，任何一个失败都返回错误且不替换已有的值
+func loadSecrets() error {
+	resolved := make([]string, len(allTenants))
+	for i, t := range allTenants {
+		if t.debugTokenRef == "" {
+			continue
+		}
+		token, err := resolveSecret(t.debugTokenRef)
+		if err != nil {
+			return fmt.Errorf("%s debug token: %v", t, err)
+		}
+		if token == "" {
+			return fmt.Errorf("%s debug token: resolved to an empty secret", t)
+		}
+		resolved[i] = token
+	}
+	for i, t := range allTenants {
+		t.debugTokenValue.Store(resolved[i])
+	}
+	return nil
+}
+
+// reloadSecretsOnHUP 收到 SIGHUP 后重新解析密钥，失败时保留原有的值，
+// 返回的 stop 停止处理并等待正在进行的重新解析结束
+func reloadSecretsOnHUP() (stop func()) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range signalChan {
+			if err := loadSecrets(); err != nil {
+				log.Println("Failed to reload secrets, keep current values:", err)
+				continue
+			}
+			log.Println("Secrets reloaded")
+		}
+	}()
+	return func() {
+		signal.Stop(signalChan)
+		close(signalChan)
+		<-done
+	}
+}
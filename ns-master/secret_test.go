@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("NS_TEST_TOKEN", "from-env")
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ ref, want string }{
+		{"literal", "literal"},
+		{"env:NS_TEST_TOKEN", "from-env"},
+		{"file:" + path, "from-file"},
+		{"exec:echo from-exec", "from-exec"},
+		{"other:value", "other:value"},
+	} {
+		got, err := resolveSecret(tc.ref)
+		if err != nil || got != tc.want {
+			t.Errorf("resolveSecret(%q) = %q, %v, want %q", tc.ref, got, err, tc.want)
+		}
+	}
+
+	for _, ref := range []string{"env:NS_TEST_UNSET", "file:" + path + ".missing", "exec:", "exec:false", "exec:/no/such/helper"} {
+		if _, err := resolveSecret(ref); err == nil {
+			t.Errorf("resolveSecret(%q) succeeded, want error", ref)
+		}
+	}
+}
+
+func TestResolveSecretErrorHidesOutput(t *testing.T) {
+	helper := filepath.Join(t.TempDir(), "helper")
+	if err := os.WriteFile(helper, []byte("#!/bin/sh\necho leaked\necho leaked >&2\nexit 3\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	_, err := resolveSecret("exec:" + helper)
+	if err == nil || strings.Contains(err.Error(), "leaked") || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("error %v, want the exit status without the command output", err)
+	}
+}
+
+func TestResolveSecretExecTimeout(t *testing.T) {
+	saved := secretExecTimeout
+	defer func() { secretExecTimeout = saved }()
+	secretExecTimeout = 100 * time.Millisecond
+
+	// 后台进程继承了 stdout，命令被结束后仍然不能阻塞
+	helper := filepath.Join(t.TempDir(), "helper")
+	if err := os.WriteFile(helper, []byte("#!/bin/sh\nsleep 10 &\nsleep 10\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"exec:sleep 10", "exec:" + helper} {
+		start := time.Now()
+		_, err := resolveSecret(ref)
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("%s: err = %v, want timeout", ref, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: hung helper blocked for %s", ref, elapsed)
+		}
+	}
+}
+
+func TestLoadSecretsKeepsValuesOnFailure(t *testing.T) {
+	t.Setenv("NS_TEST_TOKEN", "first")
+	setupTestServer(t, "1.1.1.1", &tenant{name: "teamA", debugTokenRef: "env:NS_TEST_TOKEN"})
+	allTenants[0].debugTokenRef = "default-token"
+	if err := loadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 任何一个引用失败时所有租户都保留原有的值
+	allTenants[0].debugTokenRef = "env:NS_TEST_UNSET"
+	t.Setenv("NS_TEST_TOKEN", "second")
+	if err := loadSecrets(); err == nil {
+		t.Fatal("loadSecrets succeeded with an unset variable")
+	}
+	if got := allTenants[0].debugTokenValue.Load(); got != "default-token" {
+		t.Errorf("default token = %v, want the previous value", got)
+	}
+	if got := allTenants[1].debugTokenValue.Load(); got != "first" {
+		t.Errorf("teamA token = %v, want the previous value", got)
+	}
+}
+
+func TestReloadPicksUpRotatedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("old-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setupTestServer(t, "1.1.1.1")
+	allTenants[0].debugTokenRef = "file:" + path
+	if err := loadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(reloadSecretsOnHUP())
+
+	// 按轮换工具的做法写新文件后改名替换
+	rotated := path + ".new"
+	if err := os.WriteFile(rotated, []byte("new-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(rotated, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for allTenants[0].debugTokenValue.Load() != "new-token" {
+		if time.Now().After(deadline) {
+			t.Fatalf("token = %v after SIGHUP, want new-token", allTenants[0].debugTokenValue.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 旧 token 不再有效，新 token 有效
+	def := allTenants[0]
+	if body := requestWithToken(def, "old-token").Body.String(); strings.Contains(body, "decisionTrace") {
+		t.Error("old token still accepted after rotation")
+	}
+	if body := requestWithToken(def, "new-token").Body.String(); !strings.Contains(body, "decisionTrace") {
+		t.Error("rotated token not accepted")
+	}
+}
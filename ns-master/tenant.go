@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"ns-check/internal/probe"
+)
+
+// tenantPrefix 租户接口的路径前缀，租户 name 的接口为 /t/name 加上 -endpoint
+const tenantPrefix = "/t/"
+
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tenant 一组独立的 nameserver 配置，默认租户使用 -nameservers 等全局参数
+type tenant struct {
+	name            string
+	nameservers     string
+	path            string
+	endpointURL     string
+	debugTokenRef   string
+	debugTokenValue atomic.Value
+	healthMode      probe.Mode
+	maxServed       int
+	rendered        atomic.Value
+}
+
+func newDefaultTenant() *tenant {
+	return &tenant{
+		nameservers:   nameservers,
+		path:          endpoint,
+		endpointURL:   endpointURL,
+		debugTokenRef: debugToken,
+		healthMode:    probe.Mode(healthMode),
+		maxServed:     maxServed,
+	}
+}
+
+func (t *tenant) String() string {
+	if t.name == "" {
+		return "default tenant"
+	}
+	return "tenant " + t.name
+}
+
+// tenantList 实现 flag.Value，每个 -tenant 参数为 name=ns1,ns2
+type tenantList []*tenant
+
+func (l *tenantList) String() string {
+	var names []string
+	for _, t := range *l {
+		names = append(names, t.name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *tenantList) Set(value string) error {
+	name, list, ok := strings.Cut(value, "=")
+	if !ok || !tenantNamePattern.MatchString(name) {
+		return fmt.Errorf("want name=ns1,ns2 with name of letters, digits, - or _, got %q", value)
+	}
+	for _, t := range *l {
+		if t.name == name {
+			return fmt.Errorf("duplicate tenant %q", name)
+		}
+	}
+	*l = append(*l, &tenant{name: name, nameservers: list})
+	return nil
+}
+
+// tenantTokens 实现 flag.Value，每个参数为 name=value，用于 -tenant-debug-token 等按租户的参数
+type tenantTokens map[string]string
+
+func (m tenantTokens) String() string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (m tenantTokens) Set(value string) error {
+	name, token, ok := strings.Cut(value, "=")
+	if !ok || name == "" || token == "" {
+		return fmt.Errorf("want name=value, got name %q", name)
+	}
+	m[name] = token
+	return nil
+}
+
+// setupTenants 补全每个租户的路径、endpointURL、调试 token、探测方式和返回数量上限
+func setupTenants(tenants tenantList, tokens, healthModes, maxServedCounts tenantTokens) error {
+	byName := make(map[string]*tenant)
+	for _, t := range tenants {
+		byName[t.name] = t
+		t.healthMode = probe.Mode(healthMode)
+		t.maxServed = maxServed
+		t.path = tenantPrefix + t.name + endpoint
+		u, err := url.Parse(endpointURL)
+		if err != nil {
+			return fmt.Errorf("-endpoint-url: %v", err)
+		}
+		u.Path = tenantPrefix + t.name + u.Path
+		t.endpointURL = u.String()
+	}
+	for name, token := range tokens {
+		t, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("-tenant-debug-token for unknown tenant %q", name)
+		}
+		t.debugTokenRef = token
+	}
+	for name, mode := range healthModes {
+		t, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("-tenant-health-mode for unknown tenant %q", name)
+		}
+		t.healthMode = probe.Mode(mode)
+	}
+	for name, count := range maxServedCounts {
+		t, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("-tenant-max-served for unknown tenant %q", name)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return fmt.Errorf("-tenant-max-served for tenant %q: %q is not a non-negative number", name, count)
+		}
+		t.maxServed = n
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setupTestTenants 在默认租户之外配置 teamA 和 teamB，各自带有调试 token，返回注册好的 mux
+func setupTestTenants(t *testing.T) *http.ServeMux {
+	t.Helper()
+	var tenants tenantList
+	for _, value := range []string{"teamA=9.9.9.9", "teamB=10.0.0.1,10.0.0.2"} {
+		if err := tenants.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupTestServer(t, "1.1.1.1,8.8.8.8", tenants...)
+	if err := setupTenants(tenants, tenantTokens{"teamA": "token-a", "teamB": "token-b"}, tenantTokens{}, tenantTokens{}); err != nil {
+		t.Fatal(err)
+	}
+	allTenants[0].debugTokenRef = "token-default"
+	if err := loadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if err := renderAll(); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	return mux
+}
+
+func serve(mux *http.ServeMux, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set(debugHeader, token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTenantResponses(t *testing.T) {
+	mux := setupTestTenants(t)
+
+	etags := make(map[string]string)
+	for _, tc := range []struct {
+		path, endpointURL string
+		nameservers       []string
+	}{
+		{"/nameservers", "http://127.0.0.1:5353/nameservers", []string{"1.1.1.1", "8.8.8.8"}},
+		{"/t/teamA/nameservers", "http://127.0.0.1:5353/t/teamA/nameservers", []string{"9.9.9.9"}},
+		{"/t/teamB/nameservers", "http://127.0.0.1:5353/t/teamB/nameservers", []string{"10.0.0.1", "10.0.0.2"}},
+	} {
+		rec := serve(mux, tc.path, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", tc.path, rec.Code)
+		}
+		response := decodeResponse(t, rec)
+		if !reflect.DeepEqual(response.Nameservers, tc.nameservers) || response.EndpointURL != tc.endpointURL {
+			t.Errorf("%s: %+v, want %v at %s", tc.path, response, tc.nameservers, tc.endpointURL)
+		}
+		etag := rec.Header().Get("ETag")
+		for path, other := range etags {
+			if other == etag {
+				t.Errorf("%s and %s share ETag %s", tc.path, path, etag)
+			}
+		}
+		etags[tc.path] = etag
+
+		// 每个租户的 ETag 只对自己的响应有效
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("If-None-Match", etag)
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("%s: own ETag got status %d, want 304", tc.path, rec.Code)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/t/teamA/nameservers", nil)
+	req.Header.Set("If-None-Match", etags["/t/teamB/nameservers"])
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("teamA with teamB's ETag: status %d, want 200", rec.Code)
+	}
+
+	if rec := serve(mux, "/t/teamC/nameservers", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown tenant: status %d, want 404", rec.Code)
+	}
+}
+
+func TestTenantTokenIsolation(t *testing.T) {
+	mux := setupTestTenants(t)
+
+	for _, tc := range []struct {
+		path, token string
+		trace       bool
+	}{
+		{"/t/teamA/nameservers", "token-a", true},
+		{"/t/teamA/nameservers", "token-b", false},
+		{"/t/teamA/nameservers", "token-default", false},
+		{"/t/teamB/nameservers", "token-b", true},
+		{"/t/teamB/nameservers", "token-a", false},
+		{"/nameservers", "token-default", true},
+		{"/nameservers", "token-a", false},
+	} {
+		body := serve(mux, tc.path, tc.token).Body.String()
+		if got := strings.Contains(body, "decisionTrace"); got != tc.trace {
+			t.Errorf("%s with %s: trace %v, want %v", tc.path, tc.token, got, tc.trace)
+		}
+	}
+}
+
+// TestDefaultTenantUnchanged 配置租户后默认租户的 URL、响应体和 ETag 与没有租户时相同
+func TestDefaultTenantUnchanged(t *testing.T) {
+	setupTestServer(t, "1.1.1.1,8.8.8.8")
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	before := serve(mux, "/nameservers", "")
+
+	mux = setupTestTenants(t)
+	after := serve(mux, "/nameservers", "")
+	if after.Code != http.StatusOK || after.Body.String() != before.Body.String() {
+		t.Errorf("default body with tenants %q, want %q", after.Body.String(), before.Body.String())
+	}
+	if after.Header().Get("ETag") != before.Header().Get("ETag") {
+		t.Errorf("default ETag with tenants %s, want %s", after.Header().Get("ETag"), before.Header().Get("ETag"))
+	}
+	if want := `"endpointURL":"http://127.0.0.1:5353/nameservers"`; !strings.Contains(after.Body.String(), want) {
+		t.Errorf("default body %q, want %s", after.Body.String(), want)
+	}
+}
+
+func TestTenantMaxServed(t *testing.T) {
+	var tenants tenantList
+	for _, value := range []string{"teamA=9.9.9.9,10.0.0.1,10.0.0.2", "teamB=10.0.0.1,10.0.0.2,10.0.0.3"} {
+		if err := tenants.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupTestServer(t, "1.1.1.1,8.8.8.8,9.9.9.9", tenants...)
+	// -max-served 是没有单独设置的租户的默认值
+	maxServed = 2
+	if err := setupTenants(tenants, tenantTokens{}, tenantTokens{}, tenantTokens{"teamB": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	allTenants[0] = newDefaultTenant()
+
+	for _, tc := range []struct {
+		tenant *tenant
+		want   []string
+	}{
+		{allTenants[0], []string{"1.1.1.1", "8.8.8.8"}},
+		{allTenants[1], []string{"9.9.9.9", "10.0.0.1"}},
+		{allTenants[2], []string{"10.0.0.1"}},
+	} {
+		if got := buildResponse(tc.tenant, nil); !reflect.DeepEqual(got.Nameservers, tc.want) || got.PoolSize != 3 {
+			t.Errorf("%s: %v with poolSize %d, want %v of 3", tc.tenant, got.Nameservers, got.PoolSize, tc.want)
+		}
+	}
+
+	for _, bad := range []tenantTokens{{"teamC": "1"}, {"teamA": "-1"}, {"teamA": "many"}} {
+		if err := setupTenants(tenants, tenantTokens{}, tenantTokens{}, bad); err == nil {
+			t.Errorf("-tenant-max-served %v accepted", bad)
+		}
+	}
+}
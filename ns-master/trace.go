@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const debugHeader = "X-NS-Debug"
+
+// traceEntry 记录选择流程中某个阶段的决策以及该阶段之后的 nameserver 列表
+type traceEntry struct {
+	Stage       string   `json:"stage"`
+	Detail      string   `json:"detail"`
+	Nameservers []string `json:"nameservers"`
+}
+
+// decisionTrace 收集一次请求的决策过程，nil 表示不记录
+type decisionTrace struct {
+	entries []traceEntry
+}
+
+func (t *decisionTrace) add(stage, detail string, nameservers []string) {
+	if t == nil {
+		return
+	}
+	t.entries = append(t.entries, traceEntry{
+		Stage:       stage,
+		Detail:      detail,
+		Nameservers: append([]string{}, nameservers...),
+	})
+}
+
+// debugAuthorized 判断请求是否允许返回决策过程，只接受该租户自己的 token，
+// -debug 只把决策过程写入日志，不会让响应带上决策过程
+func debugAuthorized(r *http.Request, t *tenant) bool {
+	token := r.Header.Get(debugHeader)
+	expected, _ := t.debugTokenValue.Load().(string)
+	if expected == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
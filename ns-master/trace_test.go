@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func requestWithToken(t *tenant, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, t.path, nil)
+	if token != "" {
+		req.Header.Set(debugHeader, token)
+	}
+	rec := httptest.NewRecorder()
+	t.handler(rec, req)
+	return rec
+}
+
+func TestDecisionTraceContents(t *testing.T) {
+	setupTestServer(t, " 1.1.1.1,8.8.8.8,,1.1.1.1,9.9.9.9")
+	allTenants[0].maxServed = 2
+	if err := renderAll(); err != nil {
+		t.Fatal(err)
+	}
+	def := allTenants[0]
+	def.debugTokenValue.Store("secret")
+
+	rec := requestWithToken(def, "secret")
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cc)
+	}
+	response := decodeResponse(t, rec)
+	want := []traceEntry{
+		{Stage: "source", Detail: "-nameservers flag", Nameservers: []string{" 1.1.1.1", "8.8.8.8", "", "1.1.1.1", "9.9.9.9"}},
+		{Stage: "normalize", Detail: "trimmed spaces, dropped empty and duplicate entries", Nameservers: []string{"1.1.1.1", "8.8.8.8", "9.9.9.9"}},
+		{Stage: "max-served", Detail: "kept first 2 of 3 nameservers", Nameservers: []string{"1.1.1.1", "8.8.8.8"}},
+	}
+	if !reflect.DeepEqual(response.DecisionTrace, want) {
+		t.Errorf("trace = %+v\nwant %+v", response.DecisionTrace, want)
+	}
+	if !reflect.DeepEqual(response.Nameservers, []string{"1.1.1.1", "8.8.8.8"}) || response.PoolSize != 3 {
+		t.Errorf("nameservers %v, pool size %d", response.Nameservers, response.PoolSize)
+	}
+}
+
+func TestDecisionTraceRequiresToken(t *testing.T) {
+	setupTestServer(t, "1.1.1.1,8.8.8.8")
+	def := allTenants[0]
+
+	// 未配置 token 时任何请求都拿不到决策过程
+	for _, token := range []string{"", "anything"} {
+		if body := requestWithToken(def, token).Body.String(); strings.Contains(body, "decisionTrace") {
+			t.Errorf("token %q without a configured token got the trace: %s", token, body)
+		}
+	}
+
+	def.debugTokenValue.Store("secret")
+	for _, token := range []string{"", "wrong", "secre", "secret2"} {
+		if body := requestWithToken(def, token).Body.String(); strings.Contains(body, "decisionTrace") {
+			t.Errorf("token %q got the trace: %s", token, body)
+		}
+	}
+}
+
+func TestDebugFlagOnlyLogs(t *testing.T) {
+	setupTestServer(t, "1.1.1.1,8.8.8.8")
+	debug = true
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(io.Discard)
+
+	rec := requestWithToken(allTenants[0], "")
+	if strings.Contains(rec.Body.String(), "decisionTrace") {
+		t.Errorf("-debug attached the trace to an unauthorized response: %s", rec.Body.String())
+	}
+	if rec.Header().Get("ETag") == "" {
+		t.Error("-debug response was not served from the rendered cache")
+	}
+	if !strings.Contains(logs.String(), "decision trace") || !strings.Contains(logs.String(), `"stage":"normalize"`) {
+		t.Errorf("trace not logged, log:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 子进程通过这些环境变量找到继承的监听 socket 和就绪通知管道，
+// 与 ExtraFiles 的顺序对应，文件描述符从 3 开始
+const (
+	envListenFD = "NS_MASTER_LISTEN_FD"
+	envReadyFD  = "NS_MASTER_READY_FD"
+	envDoHFD    = "NS_MASTER_DOH_FD"
+
+	upgradeReadyTimeout = 10 * time.Second
+	newConnTimeout      = 5 * time.Second
+	drainTimeout        = 30 * time.Second
+)
+
+// upgrading 为 true 表示监听 socket 已交给新进程，Serve 返回的错误是预期的
+var upgrading atomic.Bool
+
+// listen 优先使用父进程通过环境变量 env 传递的监听 socket，否则新建监听
+func listen(addr, env string) (net.Listener, error) {
+	if os.Getenv(env) == "" {
+		return net.Listen("tcp", addr)
+	}
+	var fd uintptr
+	if _, err := fmt.Sscan(os.Getenv(env), &fd); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", env, err)
+	}
+	file := os.NewFile(fd, "listener")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// notifyReady 通知父进程自己已经可以接收请求
+func notifyReady() {
+	if os.Getenv(envReadyFD) == "" {
+		return
+	}
+	var fd uintptr
+	if _, err := fmt.Sscan(os.Getenv(envReadyFD), &fd); err != nil {
+		log.Printf("Invalid %s: %v", envReadyFD, err)
+		return
+	}
+	file := os.NewFile(fd, "ready")
+	defer file.Close()
+	if _, err := file.Write([]byte("ready\n")); err != nil {
+		log.Println("Failed to notify parent process:", err)
+	}
+}
+
+// connTracker 记录还没有读到第一个请求的新连接数量
+type connTracker struct {
+	mu       sync.Mutex
+	newConns map[net.Conn]bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{newConns: make(map[net.Conn]bool)}
+}
+
+func (t *connTracker) connState(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state == http.StateNew {
+		t.newConns[conn] = true
+		return
+	}
+	delete(t.newConns, conn)
+}
+
+// waitNewConns 等待已接受的连接读到请求或关闭，最多等待 timeout
+func (t *connTracker) waitNewConns(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		t.mu.Lock()
+		n := len(t.newConns)
+		t.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// handleUpgrade 收到 SIGUSR2 时启动新的二进制并传递监听 socket，
+// 新进程就绪后当前进程停止接收请求并在处理完已有请求后退出，drained 随之关闭。
+// servers 与 lns 一一对应，第一个为 nameserver 接口，第二个为可选的 DoH 服务
+func handleUpgrade(servers []*http.Server, lns []net.Listener, tracker *connTracker, drained chan<- struct{}) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGUSR2)
+	for range signalChan {
+		log.Println("Received SIGUSR2, starting new process")
+		if err := startChild(lns); err != nil {
+			log.Println("Upgrade failed, keep serving:", err)
+			continue
+		}
+		signal.Stop(signalChan)
+
+		// 先停止接收新连接，等已接受的连接读到请求后再 Shutdown，
+		// 否则 Shutdown 期间刚读到的请求会被直接关闭而不响应
+		log.Println("New process is ready, draining connections")
+		upgrading.Store(true)
+		for i, server := range servers {
+			lns[i].Close()
+			server.SetKeepAlivesEnabled(false)
+		}
+		tracker.waitNewConns(newConnTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server *http.Server) {
+				defer wg.Done()
+				if err := server.Shutdown(ctx); err != nil {
+					log.Println("Failed to drain connections:", err)
+				}
+			}(server)
+		}
+		wg.Wait()
+		cancel()
+		close(drained)
+		return
+	}
+}
+
+// listenerFile 复制监听 socket 的文件描述符以便传给子进程
+func listenerFile(ln net.Listener) (*os.File, error) {
+	tcpListener, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("listener %T can not be passed to a new process", ln)
+	}
+	return tcpListener.File()
+}
+
+// startChild 启动新进程并等待其就绪，失败时结束子进程
+func startChild(lns []net.Listener) error {
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, ln := range lns {
+		file, err := listenerFile(ln)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{files[0], readyWriter}
+	cmd.Env = append(os.Environ(), envListenFD+"=3", envReadyFD+"=4")
+	if len(files) > 1 {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, files[1])
+		cmd.Env = append(cmd.Env, envDoHFD+"=5")
+	}
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 16)
+		_, err := readyReader.Read(buf)
+		ready <- err
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(upgradeReadyTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-ready:
+		if err == nil {
+			log.Printf("New process %d is ready", cmd.Process.Pid)
+			return nil
+		}
+		cmd.Process.Kill()
+		return fmt.Errorf("new process exited before ready: %v", <-exited)
+	case err := <-exited:
+		return fmt.Errorf("new process exited before ready: %v", err)
+	case <-timer.C:
+		cmd.Process.Kill()
+		<-exited
+		return fmt.Errorf("new process not ready after %v", upgradeReadyTimeout)
+	}
+}
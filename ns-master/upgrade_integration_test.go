@@ -0,0 +1,223 @@
+//go:build integration
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 运行方式: go test -tags integration -run Upgrade ./ns-master
+
+// buildBinary 编译 ns-master 到临时目录
+func buildBinary(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ns-master")
+	out, err := exec.Command("go", "build", "-o", path, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	return path
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startServer 启动 ns-master 并等待其开始服务，输出写入文件，
+// 这样子进程继承的是文件而不是 cmd.Wait 需要等待关闭的管道
+func startServer(t *testing.T, binary string, port int) (*exec.Cmd, string, string) {
+	t.Helper()
+	logPath := filepath.Join(t.TempDir(), "ns-master.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	cmd := exec.Command(binary, "-port", strconv.Itoa(port), "-nameservers", "10.0.0.1,10.0.0.2")
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/nameservers", port)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return cmd, url, logPath
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not serving: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// loadGenerator 持续并发请求并统计错误
+type loadGenerator struct {
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	requests atomic.Int64
+	mu       sync.Mutex
+	errors   []string
+}
+
+func startLoad(url string, workers int) *loadGenerator {
+	l := &loadGenerator{stop: make(chan struct{})}
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: workers},
+	}
+	for i := 0; i < workers; i++ {
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			for {
+				select {
+				case <-l.stop:
+					return
+				default:
+				}
+				resp, err := client.Get(url)
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						err = fmt.Errorf("status %s", resp.Status)
+					}
+				}
+				l.requests.Add(1)
+				if err != nil {
+					l.mu.Lock()
+					l.errors = append(l.errors, err.Error())
+					l.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return l
+}
+
+func (l *loadGenerator) finish() (int64, []string) {
+	close(l.stop)
+	l.wg.Wait()
+	return l.requests.Load(), l.errors
+}
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUpgradeUnderLoad(t *testing.T) {
+	binary := buildBinary(t)
+	parent, url, logPath := startServer(t, binary, freePort(t))
+
+	load := startLoad(url, 8)
+	time.Sleep(300 * time.Millisecond)
+	if err := parent.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- parent.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("old process exited with %v", err)
+		}
+	case <-time.After(40 * time.Second):
+		t.Fatal("old process did not exit after the upgrade")
+	}
+
+	logs := readLog(t, logPath)
+	match := regexp.MustCompile(`New process (\d+) is ready`).FindStringSubmatch(logs)
+	if match == nil {
+		t.Fatalf("no new process in log:\n%s", logs)
+	}
+	childPID, _ := strconv.Atoi(match[1])
+	t.Cleanup(func() { syscall.Kill(childPID, syscall.SIGKILL) })
+
+	// 旧进程退出后新进程继续服务
+	before := load.requests.Load()
+	time.Sleep(300 * time.Millisecond)
+	requests, errs := load.finish()
+	if requests == before {
+		t.Error("no requests served after the old process exited")
+	}
+	if len(errs) > 0 {
+		t.Errorf("%d of %d requests failed during the upgrade, first: %s", len(errs), requests, errs[0])
+	}
+	if !strings.Contains(logs, "Server drained, exiting") {
+		t.Errorf("old process did not drain, log:\n%s", logs)
+	}
+	t.Logf("%d requests during the upgrade", requests)
+}
+
+func TestUpgradeChildFailsParentKeepsServing(t *testing.T) {
+	binary := buildBinary(t)
+	parent, url, logPath := startServer(t, binary, freePort(t))
+
+	// 替换为启动即失败的程序，正在运行的进程仍然使用原来的文件
+	broken := binary + ".broken"
+	if err := os.WriteFile(broken, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(broken, binary); err != nil {
+		t.Fatal(err)
+	}
+
+	load := startLoad(url, 4)
+	time.Sleep(100 * time.Millisecond)
+	if err := parent.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(15 * time.Second)
+	for !strings.Contains(readLog(t, logPath), "Upgrade failed, keep serving") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no upgrade failure in log:\n%s", readLog(t, logPath))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	requests, errs := load.finish()
+
+	if len(errs) > 0 {
+		t.Errorf("%d of %d requests failed after the failed upgrade, first: %s", len(errs), requests, errs[0])
+	}
+	if err := parent.Process.Signal(syscall.Signal(0)); err != nil {
+		t.Errorf("parent is gone after the failed upgrade: %v", err)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("parent stopped serving: %v", err)
+	}
+	resp.Body.Close()
+}